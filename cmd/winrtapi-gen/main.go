@@ -1,24 +1,27 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"github.com/zzl/go-winapi-gen/codegen"
 	"github.com/zzl/go-winapi-gen/gomodel"
-	"github.com/zzl/go-winapi-gen/utils"
 	"github.com/zzl/go-winmd/apimodel"
 	"github.com/zzl/go-winmd/mdmodel"
 	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
 )
 
 func main() {
 
+	check := flag.Bool("check", false, "compare the generated code with the output dir without writing it")
+	verify := flag.Bool("verify", false, "type check the generated code for GOOS=windows")
+	migrate := flag.Bool("migrate", false, "remove the output of generator versions without file headers")
+	flag.Parse()
+
 	mdFilePath := "assets/Windows.winmd"
 	outputDir := "output"
-
-	os.MkdirAll(outputDir, os.ModePerm)
-	utils.CleanDir(outputDir)
+	renameMapPath := "assets/renames.json"
+	templatePattern := "assets/templates/*.tmpl"
 
 	mdModelParser := mdmodel.NewModelParser()
 	mdModel, err := mdModelParser.Parse(mdFilePath)
@@ -77,13 +80,63 @@ func main() {
 		"Windows.*": "winrt",
 	})
 	generator.OutputDir = outputDir
-	generator.PackageRootPath = "github.com/zzl/go-winrt-gen/output"
+	generator.ModulePath = "github.com/zzl/go-winrt-gen/output"
+	generator.GoVersion = "1.18"
 	generator.NsFullNameAsFileName = true
 	generator.FileNamePrefixToStrip = "Windows."
+	generator.GenSupport = true
 	generator.PrefixEnumValuesWithTypeName = true
+	if _, err := os.Stat(renameMapPath); err == nil {
+		generator.SymbolRenameMap, err = codegen.LoadSymbolRenameMap(renameMapPath)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	generator.Provenance, err = codegen.NewProvenance(mdFilePath, mdVersion(mdModel), apiFilter)
+	if err != nil {
+		log.Panic(err)
+	}
+	generator.TemplateTexts, err = codegen.LoadTemplateTexts(templatePattern)
+	if err != nil {
+		log.Panic(err)
+	}
+	generator.CheckOnly = *check
+	generator.MigrateOutput = *migrate
 	generator.Gen()
+	if *check {
+		generator.WriteDriftReport(os.Stdout)
+		if len(generator.Drifts) != 0 {
+			fmt.Fprintf(os.Stderr, "%d files out of date\n", len(generator.Drifts))
+			os.Exit(1)
+		}
+		println("Up to date.")
+		return
+	}
+	generator.WriteCollisionReport(os.Stdout)
+	written, unchanged, removed := generator.FileStats()
+	fmt.Printf("%d files written, %d unchanged, %d removed\n", written, unchanged, removed)
+	if *verify {
+		typeErrs, err := generator.Verify()
+		if err != nil {
+			log.Panic(err)
+		}
+		for _, typeErr := range typeErrs {
+			fmt.Fprintln(os.Stderr, typeErr)
+		}
+		if len(typeErrs) != 0 {
+			os.Exit(1)
+		}
+	}
 
-	absOutput, _ := filepath.Abs(outputDir)
-	_ = exec.Command("gofmt", "-s", "-w", absOutput).Run()
 	println("Done.")
 }
+
+// the version of the metadata assembly
+func mdVersion(mdModel *mdmodel.Model) string {
+	if mdModel.Tables.Assembly == nil || len(mdModel.Tables.Assembly.Rows) == 0 {
+		return ""
+	}
+	row := mdModel.Tables.Assembly.Rows[0]
+	return fmt.Sprintf("%d.%d.%d.%d", row.MajorVersion, row.MinorVersion,
+		row.BuildNumber, row.RevisionNumber)
+}
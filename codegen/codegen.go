@@ -5,49 +5,143 @@ import (
 	"github.com/zzl/go-win32api/win32"
 	"github.com/zzl/go-winapi-gen/gomodel"
 	"github.com/zzl/go-winapi-gen/utils"
-	"io/ioutil"
 	"log"
-	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"text/template"
 )
 
+// NsReplaceRule maps the namespaces matching Pattern (filepath.Match syntax) to Name
+type NsReplaceRule struct {
+	Pattern string
+	Name    string
+}
+
 type Generator struct {
-	goModel      *gomodel.Model
-	nsReplaceMap map[string]string
+	goModel        *gomodel.Model
+	nsReplaceRules []NsReplaceRule
 
 	OutputDir                    string
 	NsFullNameAsFileName         bool
 	FileNamePrefixToStrip        string
 	PackageRootPath              string
+	ModulePath                   string
+	GoVersion                    string
+	ExtPkgPaths                  map[string]string
+	ModuleVersions               map[string]string
 	PrefixEnumValuesWithTypeName bool
-
+	GenSupport                   bool
+	SymbolRenameMap              map[string]string
+	TemplateTexts                []string //overrides of the DefaultTemplateText templates
+	SysCallBackend               string   //SysCallBackendSyscall (default) or SysCallBackendXSys
+	FileSplit                    string   //FileSplitNone (default), FileSplitByKind, FileSplitBySize or FileSplitPerType
+	FileSplitSize                int      //bytes of unformatted code per file for FileSplitBySize
+	Parallelism                  int      //number of packages generated concurrently, GOMAXPROCS by default
+	CheckOnly                    bool     //compare the output with OutputDir instead of writing it
+	MigrateOutput                bool     //without a manifest, remove the output of versions without file headers too
+	Provenance                   *Provenance
+
+	Collisions []*SymbolCollision
+	Drifts     []*FileDrift //files differing from OutputDir in CheckOnly mode
+
+	//per package context, owned by each worker
 	contextPkgName0 string
 	contextPkgName  string
-	interfaceMap    map[string]*gomodel.Interface
-	funcTypeMap     map[string]*gomodel.FuncType
-	ownNsSet        map[string]bool
-
-	pkgSymbolSet     map[string]map[string]bool
-	contextSymbolSet map[string]bool
+	instIIDNameMap  map[string]string //rt signature -> iid var name, of the context package
+
+	//filled by Gen before the workers start and shared by them, read only afterwards
+	interfaceMap  map[string]*gomodel.Interface //by type name
+	funcTypeMap   map[string]*gomodel.FuncType
+	structMap     map[string]*gomodel.Struct //by full name
+	ownNsSet      map[string]bool
+	symbolNameMap map[symbolKey]string
+	typeNameMap   map[string]string
+
+	//owned by each worker, merged by Gen
+	usedImportSet map[string]bool
+	templates     *template.Template
+
+	genFileMap         map[string]string //files written by this run -> content hash
+	writtenFileCount   int
+	unchangedFileCount int
+	removedFileCount   int
 }
 
 func NewGenerator(goModel *gomodel.Model, nsReplaceMap map[string]string) *Generator {
+	return NewGeneratorWithRules(goModel, SortNsReplaceRules(nsReplaceMap))
+}
+
+// NewGeneratorWithRules creates a generator whose ns replace rules are tried in order,
+// the first matching rule wins
+func NewGeneratorWithRules(goModel *gomodel.Model, nsReplaceRules []NsReplaceRule) *Generator {
 	return &Generator{
-		goModel:      goModel,
-		nsReplaceMap: nsReplaceMap,
+		goModel:        goModel,
+		nsReplaceRules: nsReplaceRules,
+		ExtPkgPaths:    copyStrMap(DefaultExtPkgPaths),
+		ModuleVersions: copyStrMap(DefaultModuleVersions),
 	}
 }
 
+// copyStrMap copies the defaults a generator may override
+func copyStrMap(m map[string]string) map[string]string {
+	m2 := make(map[string]string, len(m))
+	for k, v := range m {
+		m2[k] = v
+	}
+	return m2
+}
+
+// SortNsReplaceRules orders map based rules by precedence:
+// patterns with fewer wildcards first, then longer patterns, then by pattern text
+func SortNsReplaceRules(nsReplaceMap map[string]string) []NsReplaceRule {
+	var rules []NsReplaceRule
+	for pattern, name := range nsReplaceMap {
+		rules = append(rules, NsReplaceRule{Pattern: pattern, Name: name})
+	}
+	wildcardCount := func(pattern string) int {
+		return strings.Count(pattern, "*") + strings.Count(pattern, "?") +
+			strings.Count(pattern, "[")
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		p1, p2 := rules[i].Pattern, rules[j].Pattern
+		if c1, c2 := wildcardCount(p1), wildcardCount(p2); c1 != c2 {
+			return c1 < c2
+		}
+		if len(p1) != len(p2) {
+			return len(p1) > len(p2)
+		}
+		return p1 < p2
+	})
+	return rules
+}
+
 func (this *Generator) Gen() {
 	this.interfaceMap = make(map[string]*gomodel.Interface)
 	this.funcTypeMap = make(map[string]*gomodel.FuncType)
-	this.pkgSymbolSet = make(map[string]map[string]bool)
+	this.structMap = make(map[string]*gomodel.Struct)
+	this.usedImportSet = make(map[string]bool)
+	this.genFileMap = make(map[string]string)
+	this.writtenFileCount, this.unchangedFileCount, this.removedFileCount = 0, 0, 0
+	this.Drifts = nil
+	prevManifest, err := loadManifest(filepath.Join(this.OutputDir, ManifestFileName))
+	if err == nil && prevManifest == nil {
+		prevManifest, err = scanManifest(this.OutputDir, this.MigrateOutput)
+	}
+	if err != nil {
+		log.Panic(err)
+	}
 	for _, pkg := range this.goModel.Packages {
 		for _, i := range pkg.Interfaces {
-			this.interfaceMap[i.Name] = i
+			this.interfaceMap[i.Type.Name] = i
+		}
+		for _, s := range pkg.Structs {
+			this.structMap[pkg.FullName+"."+s.Name] = s
 		}
 		for _, f := range pkg.FuncTypes {
 			name := f.Name
@@ -64,38 +158,138 @@ func (this *Generator) Gen() {
 		nsName := this.resolveNsName(pkg.FullName)
 		this.ownNsSet[nsName] = true
 	}
-	for _, pkg := range this.goModel.Packages {
-		code := this.GenPkg(pkg)
-
-		fileName := pkg.Name
-		if this.NsFullNameAsFileName {
-			fileName = pkg.FullName
-		} else {
-			println("?")
+	this.collectSymbols()
+	this.templates = this.parseTemplates()
+
+	//packages are generated concurrently, each worker with its own context
+	pkgs := this.goModel.Packages
+	parallelism := this.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	errs := make([]error, len(pkgs))
+	indexCh := make(chan int)
+	var wg sync.WaitGroup
+	var workers []*Generator
+	for n := 0; n < parallelism; n++ {
+		worker := this.newWorker()
+		workers = append(workers, worker)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexCh {
+				errs[index] = worker.writePkg(pkgs[index])
+			}
+		}()
+	}
+	for n := range pkgs {
+		indexCh <- n
+	}
+	close(indexCh)
+	wg.Wait()
+	for _, worker := range workers {
+		for imp := range worker.usedImportSet {
+			this.usedImportSet[imp] = true
+		}
+		for relPath, hash := range worker.genFileMap {
+			this.genFileMap[relPath] = hash
 		}
-		if this.FileNamePrefixToStrip != "" {
-			fileName = strings.TrimPrefix(fileName, this.FileNamePrefixToStrip)
+		this.writtenFileCount += worker.writtenFileCount
+		this.unchangedFileCount += worker.unchangedFileCount
+		this.Drifts = append(this.Drifts, worker.Drifts...)
+	}
+	for _, err := range errs {
+		if err != nil {
+			log.Panic(err)
 		}
-		fileName += ".go"
+	}
+	if this.GenSupport {
+		this.genSupportFiles(prevManifest)
+	}
+	if this.ModulePath != "" {
+		this.genGoMod()
+	}
+	err = this.updateManifest(prevManifest)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// newWorker copies the generator for generating packages concurrently,
+// the shared maps are read only during package generation
+func (this *Generator) newWorker() *Generator {
+	worker := *this
+	worker.usedImportSet = make(map[string]bool)
+	worker.genFileMap = make(map[string]string)
+	worker.writtenFileCount, worker.unchangedFileCount = 0, 0
+	worker.Drifts = nil
+	worker.templates = template.Must(this.templates.Clone()).Funcs(worker.templateFuncs())
+	return &worker
+}
+
+func (this *Generator) writePkg(pkg *gomodel.Package) error {
+	nsName := this.resolveNsName(pkg.FullName)
+	dir := strings.ReplaceAll(nsName, ".", "/")
+	files, err := this.GenPkgFiles(pkg)
+	if err != nil {
+		return err
+	}
+	for fileName, code := range files {
+		err = this.writeFile(path.Join(dir, fileName), code)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+func (this *Generator) genSupportFiles(prev *manifest) {
+	var nsNames []string
+	nsPkgsMap := make(map[string][]*gomodel.Package)
+	for _, pkg := range this.goModel.Packages {
 		nsName := this.resolveNsName(pkg.FullName)
+		if nsPkgsMap[nsName] == nil {
+			nsNames = append(nsNames, nsName)
+		}
+		nsPkgsMap[nsName] = append(nsPkgsMap[nsName], pkg)
+	}
+	for _, nsName := range nsNames {
 		dir := strings.ReplaceAll(nsName, ".", "/")
-		dirPath := filepath.Join(this.OutputDir, dir)
-		os.MkdirAll(dirPath, os.ModePerm)
-		filePath := filepath.Join(dirPath, fileName)
-
-		err := ioutil.WriteFile(filePath, []byte(code), 0666)
+		//hand-written files of the package may already provide parts of the support code
+		declaredNameSet, err := this.handWrittenNames(dir, prev)
+		if err != nil {
+			log.Panic(err)
+		}
+		code, err := this.GenSupportFile(nsName, nsPkgsMap[nsName], declaredNameSet)
+		if err != nil {
+			log.Panic(err)
+		}
+		if code == nil {
+			continue
+		}
+		err = this.writeFile(path.Join(dir, SupportFileName), code)
 		if err != nil {
 			log.Panic(err)
 		}
 	}
 }
 
+func (this *Generator) pkgFileName(pkg *gomodel.Package) string {
+	fileName := pkg.Name
+	if this.NsFullNameAsFileName {
+		fileName = pkg.FullName
+	}
+	if this.FileNamePrefixToStrip != "" {
+		fileName = strings.TrimPrefix(fileName, this.FileNamePrefixToStrip)
+	}
+	return fileName + ".go"
+}
+
 func (this *Generator) resolveNsName(pkgName string) string {
-	for name, replaceName := range this.nsReplaceMap {
-		match, _ := filepath.Match(name, pkgName)
+	for _, rule := range this.nsReplaceRules {
+		match, _ := filepath.Match(rule.Pattern, pkgName)
 		if match {
-			return replaceName
+			return rule.Name
 		}
 	}
 	return pkgName
@@ -106,395 +300,325 @@ func (this *Generator) basePkgName(pkgName string) string {
 	return pkgName[pos+1:]
 }
 
-func (this *Generator) GenPkg(pkg *gomodel.Package) string {
-	var code string
+// GenPkg generates the gofmt-ed code of a package as a single file
+func (this *Generator) GenPkg(pkg *gomodel.Package) ([]byte, error) {
+	chunks := this.genPkgChunks(pkg)
+	return this.formatCode(this.pkgFileName(pkg), this.assembleChunks(chunks),
+		this.nsReplaceImports(pkg.Imports))
+}
+
+// GenPkgFiles generates the gofmt-ed code of a package split by FileSplit,
+// keyed by file name
+func (this *Generator) GenPkgFiles(pkg *gomodel.Package) (map[string][]byte, error) {
+	chunks := this.genPkgChunks(pkg)
+	fileChunksMap := this.splitChunks(this.pkgFileName(pkg), chunks)
+	nsImports := this.nsReplaceImports(pkg.Imports)
+	files := make(map[string][]byte)
+	for fileName, fileChunks := range fileChunksMap {
+		code, err := this.formatCode(fileName, this.assembleChunks(fileChunks), nsImports)
+		if err != nil {
+			return nil, err
+		}
+		files[fileName] = code
+	}
+	return files, nil
+}
+
+func (this *Generator) genPkgChunks(pkg *gomodel.Package) []*fileChunk {
+	var chunks []*fileChunk
+	add := func(kind string, name string, native string, code string) {
+		chunks = append(chunks, &fileChunk{kind, name, pkg.FullName + "." + native, code})
+	}
 	this.contextPkgName0 = pkg.FullName
 	pkgName := this.resolveNsName(pkg.FullName)
 	this.contextPkgName = pkgName
+	rt := pkgUsesRt(pkg)
 
-	this.contextSymbolSet = this.pkgSymbolSet[pkgName]
-	if this.contextSymbolSet == nil {
-		this.contextSymbolSet = make(map[string]bool)
-		this.pkgSymbolSet[pkgName] = this.contextSymbolSet
+	for _, ta := range pkg.TypeAliases {
+		alias := utils.CapSafeName(ta.Alias)
+		add(chunkTypeAliases, alias, ta.Alias, "\t"+alias+" = "+this.baseTypeName(ta.Type)+"\n")
 	}
 
-	code += "package " + this.basePkgName(pkgName) + "\n\n"
-
-	//placeholder
-	code += "{{IMPORT}}"
-
-	if len(pkg.TypeAliases) > 0 {
-		code += "type (\n"
-		for _, ta := range pkg.TypeAliases {
-			alias := utils.CapSafeName(ta.Alias)
-			code += "\t" + alias + " = " + this.baseTypeName(nil, ta.Type) + "\n"
+	var pointerConsts []*gomodel.Const
+	for _, con := range pkg.Consts {
+		if con.Type.Pointer && con.Type.Kind != gomodel.TypeKindPrimitive {
+			pointerConsts = append(pointerConsts, con)
+			continue
+		}
+		sValue := fmt.Sprintf("%#v", con.Value)
+		typeName := this.baseTypeName(con.Type)
+		if con.Type.Unsigned && sValue[0] == '-' {
+			nValue, _ := strconv.Atoi(sValue)
+			sValue = fmt.Sprintf("%#v", uint(-nValue-1))
+			sValue = "^" + typeName + "(" + sValue + ")"
 		}
-		code += ")\n\n"
+		name := this.symbolName(con, false)
+		add(chunkConsts, name, con.Name, "\t"+name+" "+typeName+" = "+sValue+"\n")
 	}
 
-	var pointerConsts []*gomodel.Const
-	if len(pkg.Consts) > 0 {
-		code += "const (\n"
-		for _, con := range pkg.Consts {
-			if con.Type.Pointer && con.Type.Kind != gomodel.TypeKindPrimitive {
-				pointerConsts = append(pointerConsts, con)
-				continue
-			}
-			sValue := fmt.Sprintf("%#v", con.Value)
-			typeName := this.baseTypeName(nil, con.Type)
-			if con.Type.Unsigned && sValue[0] == '-' {
-				nValue, _ := strconv.Atoi(sValue)
-				sValue = fmt.Sprintf("%#v", uint(-nValue-1))
-				sValue = "^" + typeName + "(" + sValue + ")"
-			}
-			name := utils.CapSafeName(con.Name)
-			name = this.ensureUniqueSymbol(name)
-			code += "\t" + name + " " + typeName + " = " + sValue + "\n"
+	for _, con := range pointerConsts {
+		if con.Value == nil {
+			continue //?
 		}
-		code += ")\n\n"
+		typeName := this.baseTypeName(con.Type)
+		sValue := fmt.Sprintf("%#v", con.Value)
+		sValue = typeName + "(unsafe.Pointer(uintptr(" + sValue + ")))"
+		name := this.symbolName(con, false)
+		add(chunkPointerConsts, name, con.Name, "\t"+name+" = "+sValue+"\n")
 	}
 
-	if len(pointerConsts) > 0 {
-		code += "var (\n"
-		for _, con := range pointerConsts {
-			if con.Value == nil {
-				continue //?
+	for _, v := range pkg.Vars {
+		if v.Value == nil {
+			continue //?
+		}
+		sValue := fmt.Sprintf("%#v", v.Value)
+		var withEmptyLine bool
+		switch vValue := v.Value.(type) {
+		case syscall.GUID:
+			sGuid, _ := win32.GuidToStr(&vValue)
+			sValue = utils.BuildGuidExpr(sGuid)
+			withEmptyLine = true
+		case win32.PROPERTYKEY:
+			sGuid, _ := win32.GuidToStr(&vValue.Fmtid)
+			sGuid = utils.BuildGuidExpr(sGuid)
+			sValue = "win32.PROPERTYKEY{Fmtid: " + sGuid +
+				", Pid: " + strconv.Itoa(int(vValue.Pid)) + "}"
+			withEmptyLine = true
+		}
+		name := utils.CapSafeName(v.Name)
+		var sb strings.Builder
+		sb.WriteString("\t" + name + " = " + sValue + "\n")
+		if withEmptyLine {
+			sb.WriteString("\n")
+		}
+		add(chunkVars, name, v.Name, sb.String())
+	}
+
+	this.instIIDNameMap = make(map[string]string)
+	if rt {
+		instIIDNameSet := make(map[string]bool)
+		for _, inst := range pkg.CollectGenericInsts() {
+			iid := gomodel.ParameterizedIID(inst.RtSignature)
+			sIID, _ := win32.GuidToStr(&iid)
+			name := "IID_" + this.genericInstName(inst)
+			if instIIDNameSet[name] {
+				name += "_" + sIID[:8]
 			}
-			typeName := this.baseTypeName(nil, con.Type)
-			sValue := fmt.Sprintf("%#v", con.Value)
-			sValue = typeName + "(unsafe.Pointer(uintptr(" + sValue + ")))"
-			name := utils.CapSafeName(con.Name)
-			name = this.ensureUniqueSymbol(name)
-			code += "\t" + name + " = " + sValue + "\n"
+			instIIDNameSet[name] = true
+			this.instIIDNameMap[inst.RtSignature] = name
+			var sb strings.Builder
+			sb.WriteString("\t// " + inst.RtSignature + "\n")
+			sb.WriteString("\t" + name + " = " + utils.BuildGuidExpr(sIID) + "\n\n")
+			add(chunkVars, name, inst.Name, sb.String())
 		}
-		code += ")\n\n"
 	}
 
-	if len(pkg.Vars) > 0 {
-		code += "var (\n"
-		for _, v := range pkg.Vars {
-			if v.Value == nil {
-				continue //?
-			}
-			sValue := fmt.Sprintf("%#v", v.Value)
-			var withEmptyLine bool
-			switch vValue := v.Value.(type) {
-			case syscall.GUID:
-				sGuid, _ := win32.GuidToStr(&vValue)
-				sValue = utils.BuildGuidExpr(sGuid)
-				withEmptyLine = true
-			case win32.PROPERTYKEY:
-				sGuid, _ := win32.GuidToStr(&vValue.Fmtid)
-				sGuid = utils.BuildGuidExpr(sGuid)
-				sValue = "win32.PROPERTYKEY{Fmtid: " + sGuid +
-					", Pid: " + strconv.Itoa(int(vValue.Pid)) + "}"
-				withEmptyLine = true
-			}
-			name := utils.CapSafeName(v.Name)
-			code += "\t" + name + " = " + sValue + "\n"
-			if withEmptyLine {
-				code += "\n"
+	for _, enum := range pkg.Enums {
+		var sb strings.Builder
+		sb.WriteString("// enum\n")
+		if enum.Flags {
+			sb.WriteString("// flags\n")
+		}
+		typeName := this.symbolName(enum, false)
+
+		sb.WriteString("type " + typeName + " " + this.baseTypeName(enum.BaseType) + "\n\n")
+		sb.WriteString("const (\n")
+		for _, value := range enum.Values {
+			var name string
+			if this.PrefixEnumValuesWithTypeName {
+				name = typeName + "_" + utils.CapName(value.Name)
+			} else {
+				name = this.symbolName(value, false)
 			}
+			sValue := fmt.Sprintf("%v", value.Value)
+			sb.WriteString("\t" + name + " " + typeName + " = " + sValue + "\n")
+		}
+		sb.WriteString(")\n\n")
+		if rt {
+			sb.WriteString(this.execTemplate("rtValueMethods",
+				&rtValueData{typeName, false, enum.RtSignature, false}))
 		}
-		code += ")\n\n"
+		add(chunkEnums, typeName, enum.Name, sb.String())
 	}
 
-	if len(pkg.Enums) > 0 {
-		code += "// enums\n\n"
-		for _, enum := range pkg.Enums {
-			code += "// enum\n"
-			if enum.Flags {
-				code += "// flags\n"
-			}
-			typeName := utils.CapSafeName(enum.Name)
-			typeName = this.ensureUniqueSymbol(typeName)
-
-			code += "type " + typeName + " " + this.baseTypeName(nil, enum.BaseType) + "\n\n"
-			code += "const (\n"
-			for _, value := range enum.Values {
-				name := utils.CapName(value.Name)
-				if this.PrefixEnumValuesWithTypeName {
-					name = typeName + "_" + name
-				} else {
-					name = this.ensureUniqueSymbol(name)
-				}
-				sValue := fmt.Sprintf("%v", value.Value)
-				code += "\t" + name + " " + typeName + " = " + sValue + "\n"
-			}
-			code += ")\n\n"
+	ansiNameSet := make(map[string]bool)
+	for _, s := range pkg.Structs {
+		if strings.HasSuffix(s.Name, "A") {
+			ansiNameSet[s.Name] = true
 		}
 	}
-
-	if len(pkg.Structs) > 0 {
-		code += "// structs\n\n"
-
-		ansiNameSet := make(map[string]bool)
-		for _, s := range pkg.Structs {
-			if strings.HasSuffix(s.Name, "A") {
-				ansiNameSet[s.Name] = true
+	for _, s := range pkg.Structs {
+		var aliasName string
+		if strings.HasSuffix(s.Name, "W") {
+			nameWithNoW := s.Name[:len(s.Name)-1]
+			ansiName := nameWithNoW + "A"
+			if ansiNameSet[ansiName] {
+				aliasName = utils.CapSafeName(nameWithNoW)
 			}
 		}
-
-		for _, s := range pkg.Structs {
-			var aliasName string
-			if strings.HasSuffix(s.Name, "W") {
-				nameWithNoW := s.Name[:len(s.Name)-1]
-				ansiName := nameWithNoW + "A"
-				if ansiNameSet[ansiName] {
-					aliasName = utils.CapSafeName(nameWithNoW)
-				}
+		var sb strings.Builder
+		sb.WriteString(this.genStruct(s, aliasName))
+		if rt {
+			structName := this.removeEmbeddedTypeNameSuffix(utils.CapSafeName(s.Name))
+			refs := this.rtStructHasRefs(s)
+			sb.WriteString(this.execTemplate("rtValueMethods", &rtValueData{structName, true, s.RtSignature, refs}))
+			if refs {
+				sb.WriteString(this.genRtStructMirror(s, structName))
 			}
-			code += this.genStruct(s, aliasName)
 		}
+		add(chunkStructs, utils.CapSafeName(s.Name), s.Name, sb.String())
 	}
 
-	if len(pkg.FuncTypes) > 0 {
-		code += "// func types\n\n"
-		for _, ft := range pkg.FuncTypes {
-			if ft.IID == nil { //unmanaged
-				code += "type " + utils.CapSafeName(ft.Name) + " = uintptr\n"
-				code += "type " + utils.CapSafeName(ft.Name) + "_func = func("
-				for m, p := range ft.Params {
-					if m > 0 {
-						code += ", "
-					}
-					code += utils.SafeName(p.Name) + " " + this.baseTypeName(ft, p.Type)
-				}
-				code += ")"
-				if ft.ReturnType.Kind != gomodel.TypeKindVoid {
-					code += " " + this.baseTypeName(ft, ft.ReturnType)
-				}
-				code += "\n\n"
-			} else {
-				ftName := utils.CapSafeName(ft.Name)
-				pos := strings.LastIndexByte(ftName, '`')
-				if pos != -1 {
-					ftName = ftName[:pos] //remove gen suffix
-				}
-				if ft.IID != nil {
-					sIID, _ := win32.GuidToStr(ft.IID)
-					code += "//" + sIID + "\n"
+	for _, ft := range pkg.FuncTypes {
+		var sb strings.Builder
+		ftName := utils.CapSafeName(ft.Name)
+		if ft.IID == nil { //unmanaged
+			sb.WriteString("type " + ftName + " = uintptr\n")
+			sb.WriteString("type " + ftName + "_func = func(")
+			for m, p := range ft.Params {
+				if m > 0 {
+					sb.WriteString(", ")
 				}
-				//
-				genDefSuffix, _ := this.getGenSuffixes(ft)
-				code += "type " + ftName + genDefSuffix + " func("
-				params := this.transformRtParams(ft.Params)
-				for m, p := range params {
-					if m > 0 {
-						code += ", "
-					}
-					code += utils.SafeName(p.Name) + " " + this.baseTypeName(ft, p.Type)
+				sb.WriteString(utils.SafeName(p.Name) + " " + this.baseTypeName(p.Type))
+			}
+			sb.WriteString(")")
+			if ft.ReturnType.Kind != gomodel.TypeKindVoid {
+				sb.WriteString(" " + this.baseTypeName(ft.ReturnType))
+			}
+			sb.WriteString("\n\n")
+		} else {
+			pos := strings.LastIndexByte(ftName, '`')
+			if pos != -1 {
+				ftName = ftName[:pos] //remove gen suffix
+			}
+			sIID, _ := win32.GuidToStr(ft.IID)
+			sb.WriteString("//" + sIID + "\n")
+			genDefSuffix, genRefSuffix := this.getGenSuffixes(ft)
+			if genDefSuffix == "" {
+				sb.WriteString("var IID_" + ftName + " = " + utils.BuildGuidExpr(sIID) + "\n\n")
+			}
+			sb.WriteString("type " + ftName + genDefSuffix + " func(")
+			params := this.transformRtParams(ft.Params)
+			for m, p := range params {
+				if m > 0 {
+					sb.WriteString(", ")
 				}
-				if ft.ReturnType.Kind != gomodel.TypeKindVoid {
-					if len(params) != 0 {
-						code += ", "
-					}
-					code += "pResult *" + this.baseTypeName(ft, ft.ReturnType)
+				sb.WriteString(utils.SafeName(p.Name) + " " + this.baseTypeName(p.Type))
+			}
+			if ft.ReturnType.Kind != gomodel.TypeKindVoid {
+				if len(params) != 0 {
+					sb.WriteString(", ")
 				}
-				code += ")"
-				code += " com.Error"
-				code += "\n\n"
+				sb.WriteString("pResult *" + this.baseTypeName(ft.ReturnType))
 			}
-		}
-	}
-
-	if len(pkg.Interfaces) > 0 {
-		code += "// interfaces\n\n"
-		for _, intf := range pkg.Interfaces {
-			if intf.Rt {
-				code += this.genRtInterface(intf)
+			sb.WriteString(") com.Error\n\n")
+			//the iid the delegate answers QueryInterface with
+			sb.WriteString("func (this " + ftName + genRefSuffix + ") IID() *syscall.GUID {\n")
+			if genDefSuffix == "" {
+				sb.WriteString("\treturn &IID_" + ftName + "\n")
 			} else {
-				code += this.genInterface(intf)
+				sb.WriteString("\treturn ParameterizedIID(" + this.rtSignatureExpr(ft.IID, ft.GetGenericParams()) + ")\n")
 			}
+			sb.WriteString("}\n\n")
 		}
+		add(chunkFuncTypes, ftName, ft.Name, sb.String())
 	}
 
-	if len(pkg.RtClasses) > 0 {
-		code += "// classes\n\n"
-		for _, rtClass := range pkg.RtClasses {
-			code += this.genClass(rtClass)
+	for _, intf := range pkg.Interfaces {
+		name := utils.CapSafeName(intf.Name)
+		if pos := strings.LastIndexByte(name, '`'); pos != -1 {
+			name = name[:pos] //remove gen suffix
 		}
-	}
-
-	if len(pkg.SysCalls) > 0 {
-		ansiNameSet := make(map[string]bool)
-		for _, sc := range pkg.SysCalls {
-			if strings.HasSuffix(sc.ProcName, "A") {
-				ansiNameSet[sc.ProcName] = true
-			}
-		}
-
-		code += "var (\n"
-		for _, sc := range pkg.SysCalls {
-			code += "\tp" + utils.CapSafeName(sc.ProcName) + "\tuintptr\n"
-		}
-		code += ")\n\n"
-		for _, sc := range pkg.SysCalls {
-			var aliasName string
-			if strings.HasSuffix(sc.ProcName, "W") {
-				nameWithNoW := sc.ProcName[:len(sc.ProcName)-1]
-				ansiName := nameWithNoW + "A"
-				if ansiNameSet[ansiName] {
-					aliasName = utils.CapSafeName(nameWithNoW)
-				}
-			}
-			code += this.genSysCall(sc, aliasName)
+		if intf.Rt {
+			add(chunkInterfaces, name, intf.Name, this.genRtInterface(intf))
+		} else {
+			add(chunkInterfaces, name, intf.Name, this.genInterface(intf))
 		}
 	}
 
-	//
-	var imports []string
-	if strings.Contains(code, "unsafe.") {
-		imports = append(imports, "unsafe")
-	}
-	if strings.Contains(code, "syscall.") {
-		imports = append(imports, "syscall")
-	}
-	if strings.Contains(code, "log.") {
-		imports = append(imports, "log")
+	for _, rtClass := range pkg.RtClasses {
+		add(chunkClasses, utils.CapSafeName(rtClass.Name), rtClass.Name, this.genClass(rtClass))
 	}
 
-	if strings.Contains(code, "win32.") {
-		imports = append(imports, "github.com/zzl/go-win32api/win32")
-	}
-	if strings.Contains(code, "com.") {
-		imports = append(imports, "github.com/zzl/go-com/com")
+	for _, sc := range pkg.SysCalls {
+		funcName := this.symbolName(sc, false)
+		add(chunkSysCallVars, funcName, sc.ProcName, this.execTemplate("sysCallVar", &sysCallData{
+			SysCall:  sc,
+			FuncName: funcName,
+		}))
 	}
-	imports = this.mergeImports(pkg.Imports, imports)
-	imports = this.nsReplaceImports(imports)
-	importCode := ""
-	if len(imports) > 0 {
-		importCode += "import (\n"
-		packageRootPath := this.PackageRootPath
-		if packageRootPath != "" {
-			if packageRootPath[len(packageRootPath)-1] != '/' {
-				packageRootPath += "/"
-			}
+	aliasNameMap := sysCallAliasNames(pkg)
+	for _, sc := range pkg.SysCalls {
+		funcName := this.symbolName(sc, false)
+		var aliasName string
+		if _, ok := aliasNameMap[sc]; ok {
+			aliasName = this.symbolName(sc, true)
 		}
-		for _, imp := range imports {
-			if this.ownNsSet[imp] {
-				imp = strings.ReplaceAll(imp, ".", "/")
-				imp = packageRootPath + imp
-			}
-			importCode += "\t\"" + imp + "\"\n"
-		}
-		importCode += ")\n\n"
+		add(chunkSysCalls, funcName, sc.ProcName, this.genSysCall(sc, aliasName))
 	}
-	code = strings.Replace(code, "{{IMPORT}}", importCode, 1)
-	return code
+	return chunks
 }
 
-func (this *Generator) ensureUniqueSymbol(symbol string) string {
-	if this.contextSymbolSet[symbol] {
-		symbol += "_"
+// import path of a resolved ns name, an external package name or a std package
+func (this *Generator) importPath(nsName string) string {
+	if this.ownNsSet[nsName] {
+		path := strings.ReplaceAll(nsName, ".", "/")
+		packageRootPath := this.packageRootPath()
+		if packageRootPath != "" {
+			path = packageRootPath + "/" + path
+		}
+		return path
+	}
+	if path, ok := this.ExtPkgPaths[nsName]; ok {
+		return path
 	}
-	this.contextSymbolSet[symbol] = true
-	return symbol
+	return nsName
 }
 
-func (this *Generator) mergeImports(imports []string, imports2 []string) []string {
-	importSet := make(map[string]bool)
-	for _, imp := range imports {
-		importSet[imp] = true
+func (this *Generator) packageRootPath() string {
+	if this.PackageRootPath != "" {
+		return strings.TrimSuffix(this.PackageRootPath, "/")
 	}
-	for _, imp := range imports2 {
-		if !importSet[imp] {
-			imports = append(imports, imp)
-		}
-	}
-	return imports
+	return this.ModulePath
 }
 
 func (this *Generator) genSysCall(sc *gomodel.SysCall, aliasName string) string {
-	code := ""
-	funcName := utils.CapName(sc.ProcName)
-	funcName = this.ensureUniqueSymbol(funcName)
-	if aliasName != "" {
-		aliasName = this.ensureUniqueSymbol(aliasName)
-		code += "var " + aliasName + " = " + funcName + "\n"
-	}
-	code += "func " + funcName + "("
-	var pNames []string
-	var pTypes []string
-	for n, p := range sc.Params {
-		if n > 0 {
-			code += ", "
-		}
-		pType := this.baseTypeName(nil, p.Type)
-		pTypes = append(pTypes, pType)
-		pName := utils.SafeName(p.Name)
-		pNames = append(pNames, pName)
-		code += pName + " " + pType
-	}
-	code += ")"
-	if sc.ReturnType.Kind != gomodel.TypeKindVoid && sc.ReturnLastError {
-		code += " (" + this.baseTypeName(nil, sc.ReturnType) + ", WIN32_ERROR)"
-	} else if sc.ReturnType.Kind != gomodel.TypeKindVoid {
-		code += " " + this.baseTypeName(nil, sc.ReturnType)
-	} else if sc.ReturnLastError {
-		code += " WIN32_ERROR"
-	}
-
-	code += " {\n"
-
-	libName := strings.ReplaceAll(strings.ToLower(sc.LibName), "-", "_")
-	if strings.HasSuffix(libName, ".dll") {
-		libName = libName[:len(libName)-4]
-	}
-	libName = "lib" + strings.ToUpper(string(libName[0])) + libName[1:]
-
-	code += "\taddr := lazyAddr(&p" + funcName +
-		", " + libName + ", \"" + sc.ProcName + "\")\n"
-
-	code += "\t"
-	if sc.ReturnType.Kind != gomodel.TypeKindVoid && sc.ReturnLastError {
-		code += "ret, _, err := "
-	} else if sc.ReturnType.Kind != gomodel.TypeKindVoid {
-		code += "ret, _, _ := "
-	} else if sc.ReturnLastError {
-		code += "_, _, err := "
-	}
-	code += "syscall.SyscallN(addr"
-	for n, p := range sc.Params {
-		code += ", " + this.genCastToUintptr(p.Type, pTypes[n], utils.SafeName(p.Name))
-	}
-	code += ")\n"
-	if sc.ReturnType.Kind != gomodel.TypeKindVoid {
-		code += "\treturn " + this.genCastFromUintptr(nil, sc.ReturnType, "ret")
-		if sc.ReturnLastError {
-			code += ", WIN32_ERROR(err)"
-		}
-		code += "\n"
-	} else if sc.ReturnLastError {
-		code += "\treturn WIN32_ERROR(err)\n"
-	}
-	code += "}\n\n"
-	return code
+	return this.execTemplate("sysCall", &sysCallData{
+		SysCall:   sc,
+		FuncName:  this.symbolName(sc, false),
+		AliasName: aliasName,
+	})
 }
 
+// transformRtParams splits array params to their abi length and pointer params
 func (this *Generator) transformRtParams(params []*gomodel.Param) []*gomodel.Param {
 	var params2 []*gomodel.Param
 	for _, p := range params {
-		if p.Type.Kind == gomodel.TypeKindArray {
-			if p.Type.Size.TotalSize != p.Type.Size.AlignSize {
-				log.Panic("?")
+		if p.ArrayKind != gomodel.ArrayNone {
+			lengthTypeName, ptrPrefix := "uint32", "*"
+			if p.ArrayKind == gomodel.ArrayReceive {
+				lengthTypeName, ptrPrefix = "*uint32", "**"
 			}
 			pLength := &gomodel.Param{
 				Name:  p.Name + "Length",
 				Flags: p.Flags,
 				Type: &gomodel.Type{
-					Name:     "uint32",
+					Name:     lengthTypeName,
 					Kind:     gomodel.TypeKindPrimitive,
 					Unsigned: true,
+					Pointer:  p.ArrayKind == gomodel.ArrayReceive,
 					Size:     gomodel.TypeSize{4, 4},
 				},
 			}
+			if pLength.Type.Pointer {
+				pLength.Type.Size = gomodel.TypeSize{gomodel.PtrSize, gomodel.PtrSize}
+			}
 			params2 = append(params2, pLength)
 			pPointer := &gomodel.Param{
 				Name:  p.Name,
 				Flags: p.Flags,
 				Type: &gomodel.Type{
-					Name:    "*" + strings.TrimPrefix(p.Type.Name, "[]"),
+					Name:    ptrPrefix + strings.TrimPrefix(p.Type.Name, "[]"),
 					Kind:    gomodel.TypeKindPointer,
 					Pointer: true,
 					Size:    gomodel.TypeSize{gomodel.PtrSize, gomodel.PtrSize},
@@ -508,239 +632,125 @@ func (this *Generator) transformRtParams(params []*gomodel.Param) []*gomodel.Par
 	return params2
 }
 
-func (this *Generator) genInterface(intf *gomodel.Interface) string {
-	code := ""
-	sIID, _ := win32.GuidToStr(&intf.IID)
-	code += "// " + sIID + "\n"
-	intfName := this.baseTypeName(nil, intf.Type)
-	if intfName[0] != '*' {
-		log.Panic("?")
-	}
-	intfName = intfName[1:]
-	code += "var IID_" + intfName + " = " + utils.BuildGuidExpr(sIID) + "\n\n"
+// rtCallData holds the abi args of a winrt method call
+type rtCallData struct {
+	Args  string   //", arg1, arg2.."
+	Boxes []string //statements boxing the optional value args, setting err
+	Pre   []string //statements before the call
+	Post  []string //statements after the call
+}
 
-	//
-	var superIntfName string
-	if len(intf.Extends) > 0 {
-		superIntfName = this.baseTypeName(nil, intf.Extends[0])
-		if superIntfName[0] != '*' {
-			log.Panic("?")
+// rtCall builds the abi args of params by their array conventions,
+// pass and fill arrays go as length and pointer, receive arrays come back as callee allocated buffers,
+// optional values are boxed as IReference args before the call
+func (this *Generator) rtCall(params []*gomodel.Param) *rtCallData {
+	data := &rtCallData{}
+	for _, p := range params {
+		name := utils.SafeName(p.Name)
+		lengthName, ptrName := "_"+name+"Length", "_"+name+"Ptr"
+		switch p.ArrayKind {
+		case gomodel.ArrayPass:
+			data.Args += ", uintptr(len(" + name + ")), uintptr(arrayArg(" + name + "))"
+		case gomodel.ArrayFill:
+			data.Pre = append(data.Pre, ptrName+" := fillArrayArg("+name+")")
+			data.Args += ", uintptr(len(" + name + ")), uintptr(" + ptrName + ")"
+			data.Post = append(data.Post, "fromAbiArray("+name+", "+ptrName+")")
+		case gomodel.ArrayReceive:
+			data.Pre = append(data.Pre, "var "+lengthName+" uint32", "var "+ptrName+" unsafe.Pointer")
+			data.Args += ", uintptr(unsafe.Pointer(&" + lengthName + ")), uintptr(unsafe.Pointer(&" + ptrName + "))"
+			data.Post = append(data.Post, "if items := receiveArray["+this.arrayElemTypeName(p.Type)+
+				"]("+lengthName+", "+ptrName+"); "+name+" != nil {\n\t\t*"+name+" = items\n\t}")
+		default:
+			if this.isBoxedReference(p.Type) {
+				refName := "_" + name + "Ref"
+				data.Boxes = append(data.Boxes, refName+", err := boxReferenceArg("+name+")")
+				data.Args += ", " + refName
+			} else {
+				data.Args += ", " + this.genCastToUintptr(p.Type, this.baseTypeName(p.Type), name)
+			}
 		}
-		superIntfName = superIntfName[1:]
 	}
+	return data
+}
 
-	//
-	code += "type " + intfName + "Interface interface {\n"
-	if superIntfName != "" {
-		code += "\t" + superIntfName + "Interface\n"
-	}
-	for _, method := range intf.Methods {
-		name := utils.CapSafeName(method.Name)
-		code += "\t" + name + "("
-		for m, p := range method.Params {
-			if m > 0 {
-				code += ", "
-			}
-			pName := utils.SafeName(p.Name)
-			code += pName + " " + this.baseTypeName(nil, p.Type)
-		}
-		code += ")"
-		retType := this.baseTypeName(nil, method.ReturnType)
-		if retType != "" {
-			code += " " + retType
+// rtResults builds the result list of a winrt method,
+// methods boxing optional values return an error too
+func (this *Generator) rtResults(method *gomodel.Method) string {
+	var fallible bool
+	for _, p := range method.Params {
+		if p.ArrayKind == gomodel.ArrayNone && this.isBoxedReference(p.Type) {
+			fallible = true
 		}
-		code += "\n"
 	}
-	code += "}\n\n"
-
-	//
-	code += "type " + intfName + "Vtbl struct {\n"
-	if superIntfName != "" {
-		code += "\t" + superIntfName + "Vtbl\n"
+	if method.ReturnType.Kind == gomodel.TypeKindVoid {
+		if fallible {
+			return " error"
+		}
+		return ""
 	}
-	for _, method := range intf.Methods {
-		name := utils.CapSafeName(method.Name)
-		code += "\t" + name + " uintptr\n"
+	if fallible {
+		return " (" + this.rtResultTypeName(method.ReturnType) + ", error)"
 	}
-	code += "}\n\n"
+	return " " + this.rtResultTypeName(method.ReturnType)
+}
 
-	//
-	code += "type " + intfName + " struct {\n"
-	if superIntfName == "" {
-		code += "\tLpVtbl *[1024]uintptr\n"
-	} else {
-		code += "\t" + superIntfName + "\n"
-	}
-	code += "}\n\n"
+func (this *Generator) arrayElemTypeName(typ *gomodel.Type) string {
+	return strings.TrimPrefix(this.baseTypeName(typ), "[]")
+}
 
-	code += "func (this *" + intfName + ") Vtbl() *" + intfName + "Vtbl {\n"
+func (this *Generator) genInterface(intf *gomodel.Interface) string {
+	sIID, _ := win32.GuidToStr(&intf.IID)
+	intfName := this.baseTypeName(intf.Type)
+	if intfName[0] != '*' {
+		log.Panic("?")
+	}
+	var superIntfName string
 	if len(intf.Extends) > 0 {
-		code += "\treturn (*" + intfName + "Vtbl)(unsafe.Pointer(this.IUnknown.LpVtbl))\n"
-	} else {
-		code += "\treturn (*" + intfName + "Vtbl)(unsafe.Pointer(this.LpVtbl))\n"
-	}
-	code += "}\n\n"
-
-	for _, method := range intf.Methods {
-		name := utils.CapName(method.Name)
-		code += "func (this *" + intfName + ") " + name + "("
-		params := method.Params
-		var pTypes []string
-		for m, p := range params {
-			if m > 0 {
-				code += ", "
-			}
-			pName := utils.SafeName(p.Name)
-			pType := this.baseTypeName(nil, p.Type)
-			pTypes = append(pTypes, pType)
-			code += pName + " " + pType
-		}
-		code += ")"
-		retType := this.baseTypeName(nil, method.ReturnType)
-		if retType != "" {
-			code += " " + retType
-		}
-		code += " {\n"
-
-		if retType != "" {
-			code += "\tret, _, _ :"
-		} else {
-			code += "\t_, _, _ "
-		}
-
-		code += "= syscall.SyscallN(this.Vtbl()." + name +
-			", uintptr(unsafe.Pointer(this))"
-		for m, p := range params {
-			code += ", " + this.genCastToUintptr(p.Type, pTypes[m], utils.SafeName(p.Name))
-		}
-		code += ")\n"
-		if retType != "" {
-			code += "\treturn " + this.genCastFromUintptr(nil, method.ReturnType, "ret") + "\n"
+		superIntfName = this.baseTypeName(intf.Extends[0])
+		if superIntfName[0] != '*' {
+			log.Panic("?")
 		}
-		code += "}\n\n"
+		superIntfName = superIntfName[1:]
 	}
-	return code
+	return this.execTemplate("interface", &interfaceData{
+		Interface:     intf,
+		IIDStr:        sIID,
+		IntfName:      intfName[1:],
+		SuperIntfName: superIntfName,
+	})
 }
 
 func (this *Generator) genRtInterface(intf *gomodel.Interface) string {
-	code := ""
 	sIID, _ := win32.GuidToStr(&intf.IID)
-	code += "// " + sIID + "\n"
-	intfName := this.baseTypeName(nil, intf.Type)
+	intfName := this.baseTypeName(intf.Type)
 	if intfName[0] != '*' {
 		log.Panic("?")
 	}
-	intfName = intfName[1:]
-	code += "var IID_" + intfName + " = " + utils.BuildGuidExpr(sIID) + "\n\n"
-
-	//
-	var superIntfName string
-	superIntfName = "win32.IInspectable"
-
-	//
 	genDefSuffix, genRefSuffix := this.getGenSuffixes(intf)
+	return this.execTemplate("rtInterface", &interfaceData{
+		Interface:     intf,
+		IIDStr:        sIID,
+		IntfName:      intfName[1:],
+		GenDefSuffix:  genDefSuffix,
+		GenRefSuffix:  genRefSuffix,
+		SignatureExpr: this.rtSignatureExpr(&intf.IID, intf.GetGenericParams()),
+	})
+}
 
-	code += "type " + intfName + "Interface" + genDefSuffix + " interface {\n"
-	code += "\t" + superIntfName + "Interface\n"
-	for _, method := range intf.Methods {
-		name := utils.CapSafeName(method.Name)
-		code += "\t" + name + "("
-		params := this.transformRtParams(method.Params)
-		for m, p := range params {
-			if m > 0 {
-				code += ", "
-			}
-			pName := utils.SafeName(p.Name)
-			code += pName + " " + this.baseTypeName(intf, p.Type)
-		}
-		code += ")"
-		if method.ReturnType.Kind != gomodel.TypeKindVoid {
-			code += " " + this.baseTypeName(intf, method.ReturnType)
-		}
-		code += "\n"
-	}
-	code += "}\n\n"
-
-	//
-	code += "type " + intfName + "Vtbl struct {\n"
-	if superIntfName != "" {
-		code += "\t" + superIntfName + "Vtbl\n"
+// rtSignatureExpr builds the signature expression of an interface or delegate,
+// a generic definition signs its instances with the signatures of the type args
+func (this *Generator) rtSignatureExpr(iid *syscall.GUID, genParams []string) string {
+	if len(genParams) == 0 {
+		return strconv.Quote(gomodel.RtGuidSignature(iid))
 	}
-	for _, method := range intf.Methods {
-		name := utils.CapSafeName(method.Name)
-		code += "\t" + name + " uintptr\n"
-	}
-	code += "}\n\n"
-
-	//
-	code += "type " + intfName + genDefSuffix + " struct {\n"
-	code += "\t" + superIntfName + "\n"
-	code += "}\n\n"
-
-	code += "func (this *" + intfName + genRefSuffix + ") Vtbl() *" + intfName + "Vtbl {\n"
-	code += "\treturn (*" + intfName + "Vtbl)(unsafe.Pointer(this.IUnknown.LpVtbl))\n"
-	code += "}\n\n"
-
-	for _, method := range intf.Methods {
-		name := utils.CapName(method.Name)
-		code += "func (this *" + intfName + genRefSuffix + ") " + name + "("
-		params := this.transformRtParams(method.Params)
-
-		var pTypes []string
-		for m, p := range params {
-			if m > 0 {
-				code += ", "
-			}
-			pName := utils.SafeName(p.Name)
-			pType := this.baseTypeName(intf, p.Type)
-			pTypes = append(pTypes, pType)
-			code += pName + " " + pType
-		}
-		code += ")"
-
-		var hasRet bool
-		var retTypeName string
-		if method.ReturnType.Kind != gomodel.TypeKindVoid {
-			retTypeName = this.baseTypeName(intf, method.ReturnType)
-			code += " " + retTypeName
-			hasRet = true
-		}
-		code += " {\n"
-		if hasRet {
-			if retTypeName == "string" {
-				code += "\tvar _result win32.HSTRING\n"
-			} else {
-				code += "\tvar _result " + retTypeName + "\n"
-			}
-		}
-		code += "\t_hr, _, _ :"
-
-		code += "= syscall.SyscallN(this.Vtbl()." + name +
-			", uintptr(unsafe.Pointer(this))"
-		for m, p := range params {
-			code += ", " + this.genCastToUintptr(p.Type, pTypes[m], utils.SafeName(p.Name))
-		}
-		if hasRet {
-			code += ", uintptr(unsafe.Pointer(&_result))"
-		}
-		code += ")\n"
-		code += "\t_= _hr\n"
-		if hasRet {
-			if retTypeName == "string" {
-				code += "\treturn HStringToStrAndFree(_result)\n"
-			} else if method.ReturnType.Kind == gomodel.TypeKindInterface {
-				code += "\tcom.AddToScope(_result)\n"
-				code += "\treturn _result\n"
-			} else if method.ReturnType.Kind == gomodel.TypeKindGenericParam {
-				code += "\treturn PostProcessGenericResult(_result)\n"
-			} else {
-				code += "\treturn _result\n"
-			}
+	sigExpr := "\"pinterface(" + gomodel.RtGuidSignature(iid) + ";\" + "
+	for n, gp := range genParams {
+		if n > 0 {
+			sigExpr += " + \";\" + "
 		}
-		code += "}\n\n"
+		sigExpr += "rtSignatureOf[" + gp + "]()"
 	}
-
-	return code
+	return sigExpr + " + \")\""
 }
 
 func (this *Generator) getGenSuffixes(genType gomodel.GenericType) (string, string) {
@@ -755,7 +765,7 @@ func (this *Generator) getGenSuffixes(genType gomodel.GenericType) (string, stri
 				genDefSuffix += ", "
 				genRefSuffix += ", "
 			}
-			genDefSuffix += gp + " any"
+			genDefSuffix += gp + " RtType[" + gp + "]"
 			genRefSuffix += gp
 		}
 		genDefSuffix += "]"
@@ -764,10 +774,10 @@ func (this *Generator) getGenSuffixes(genType gomodel.GenericType) (string, stri
 	return genDefSuffix, genRefSuffix
 }
 
-func (this *Generator) genCastFromUintptr(genType gomodel.GenericType, typ *gomodel.Type, varName string) string {
+func (this *Generator) genCastFromUintptr(typ *gomodel.Type, varName string) string {
 	code := ""
 	kind := typ.Kind
-	typName := this.baseTypeName(genType, typ)
+	typName := this.baseTypeName(typ)
 	if kind == gomodel.TypeKindPointer {
 		code += "(" + typName + ")("
 		if typName != "unsafe.Pointer" {
@@ -846,7 +856,7 @@ func (this *Generator) genCastToUintptr(typ *gomodel.Type, varType, varName stri
 	} else if typ.Kind == gomodel.TypeKindPrimitive && typ.Pointer { //uintptr
 		code += varName
 	} else if typ.Kind == gomodel.TypeKindGenericParam {
-		code += "uintptr(CastArgToPointer(" + varName + "))"
+		code += varName + ".AbiArg()"
 	} else {
 		code += "uintptr(" + varName + ")"
 	}
@@ -854,25 +864,9 @@ func (this *Generator) genCastToUintptr(typ *gomodel.Type, varType, varName stri
 }
 
 func (this *Generator) genStruct(s *gomodel.Struct, aliasName string) string {
-	code := ""
 	structName := utils.CapSafeName(s.Name)
 	structName = this.removeEmbeddedTypeNameSuffix(structName)
-	if aliasName != "" {
-		code += "type " + aliasName + " = " + structName + "\n"
-	}
-	code += "type " + structName + " struct {\n"
-	for _, f := range s.Fields {
-		name := utils.CapSafeName(f.Name)
-		typeName := this.baseTypeName(nil, f.Type)
-		if typeName == "string" {
-			typeName = "win32.HSTRING"
-		}
-		if strings.HasPrefix(name, "Anonymous") {
-			code += "\t" + typeName + "\n"
-		} else {
-			code += "\t" + name + " " + typeName + "\n"
-		}
-	}
+	var unionField string
 	if len(s.UnionFields) > 0 {
 		var size int
 		var alignSize int
@@ -885,16 +879,13 @@ func (this *Generator) genStruct(s *gomodel.Struct, aliasName string) string {
 				alignSize = fSize.AlignSize
 			}
 		}
-		var embedFieldType string
 		for _, uf := range s.UnionFields {
 			if uf.Name == "Anonymous" && uf.Type.Size.TotalSize == size {
-				embedFieldType = this.baseTypeName(nil, uf.Type)
+				unionField = this.baseTypeName(uf.Type)
 				break
 			}
 		}
-		if embedFieldType != "" {
-			code += "\t" + embedFieldType + "\n"
-		} else {
+		if unionField == "" {
 			var elemType string
 			switch alignSize {
 			case 1:
@@ -909,34 +900,86 @@ func (this *Generator) genStruct(s *gomodel.Struct, aliasName string) string {
 				panic("?")
 			}
 			elemCount := size / alignSize
-			typeName := fmt.Sprintf("[%d]%s", elemCount, elemType)
-			code += "\tData" + typeName + "\n"
+			unionField = fmt.Sprintf("Data [%d]%s", elemCount, elemType)
 		}
 	}
-	code += "}\n\n"
-	for _, uf := range s.UnionFields {
-		name := utils.CapSafeName(uf.Name)
-		typeName := this.baseTypeName(nil, uf.Type)
-		code += "func (this *" + structName + ") " + name + "() *" + typeName + " {\n"
-		code += "\treturn (*" + typeName + ")(unsafe.Pointer(this))\n"
-		code += "}\n\n"
+	return this.execTemplate("struct", &structData{
+		Struct:     s,
+		StructName: structName,
+		AliasName:  aliasName,
+		UnionField: unionField,
+	})
+}
 
-		code += "func (this *" + structName + ") " + name + "Val() " + typeName + " {\n"
-		code += "\treturn *(*" + typeName + ")(unsafe.Pointer(this))\n"
-		code += "}\n\n"
+// rtTypeHasRefs reports whether the values of a winrt type own hstrings or interfaces
+func (this *Generator) rtTypeHasRefs(typ *gomodel.Type) bool {
+	switch typ.Kind {
+	case gomodel.TypeKindString, gomodel.TypeKindInterface:
+		return true
+	case gomodel.TypeKindStruct:
+		if s := this.structMap[typ.Name]; s != nil {
+			return this.rtStructHasRefs(s)
+		}
 	}
-	return code
+	return false
 }
 
-func (this *Generator) baseTypeName(genType gomodel.GenericType, typ *gomodel.Type) string {
-	name := this._baseTypeName(genType, typ.Name)
+// rtResultTypeName is the type name winrt methods return typ as,
+// the Go mirror for structs owning references, which are released on return
+func (this *Generator) rtResultTypeName(typ *gomodel.Type) string {
+	name := this.baseTypeName(typ)
+	if typ.Kind == gomodel.TypeKindStruct && this.rtTypeHasRefs(typ) {
+		name += "Value"
+	}
+	return name
+}
+
+func (this *Generator) rtStructHasRefs(s *gomodel.Struct) bool {
+	for _, f := range s.Fields {
+		if this.rtTypeHasRefs(f.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// genRtStructMirror generates the Go mirror of a winrt struct owning references,
+// with Go strings for the hstrings, and the conversions managing the references
+func (this *Generator) genRtStructMirror(s *gomodel.Struct, structName string) string {
+	data := &rtStructMirrorData{StructName: structName}
+	for _, f := range s.Fields {
+		field := &rtMirrorFieldData{
+			Name:     utils.CapSafeName(f.Name),
+			TypeName: this.baseTypeName(f.Type),
+		}
+		switch f.Type.Kind {
+		case gomodel.TypeKindString:
+			field.Ref = "string"
+		case gomodel.TypeKindInterface:
+			field.Ref = "interface"
+		case gomodel.TypeKindStruct:
+			if this.rtTypeHasRefs(f.Type) {
+				field.Ref = "struct"
+				field.TypeName += "Value"
+			}
+		}
+		data.Fields = append(data.Fields, field)
+	}
+	return this.execTemplate("rtStructMirror", data)
+}
+
+func (this *Generator) baseTypeName(typ *gomodel.Type) string {
+	if typ.Kind == gomodel.TypeKindGenericParam {
+		return typ.Name
+	}
+	name := this._baseTypeName(typ.Name)
 	if len(typ.GenericArgs) > 0 {
 		name += "["
 		for n, ga := range typ.GenericArgs {
 			if n > 0 {
 				name += ", "
 			}
-			name += this.baseTypeName(genType, ga)
+			name += this.genericArgTypeName(ga)
 		}
 		name += "]"
 	}
@@ -944,6 +987,72 @@ func (this *Generator) baseTypeName(genType gomodel.GenericType, typ *gomodel.Ty
 	return name
 }
 
+// the wrappers of the fundamental types implementing RtType
+var rtWrapperTypeMap = map[string]string{
+	"bool": "Boolean", "int8": "Int8", "uint8": "UInt8", "byte": "UInt8",
+	"int16": "Int16", "uint16": "UInt16",
+	"int32": "Int32", "uint32": "UInt32",
+	"int64": "Int64", "uint64": "UInt64",
+	"float32": "Single", "float64": "Double",
+	"string": "String", "syscall.GUID": "Guid",
+	"interface{}": "*Object",
+}
+
+// the Windows.Foundation structs PropertyValue boxes
+var rtBoxableStructSet = map[string]bool{
+	"Windows.Foundation.DateTime": true, "Windows.Foundation.TimeSpan": true,
+	"Windows.Foundation.Point": true, "Windows.Foundation.Size": true,
+	"Windows.Foundation.Rect": true,
+}
+
+// isBoxedReference reports whether typ is an IReference of a type PropertyValue boxes,
+// such params are declared as optional values and boxed on the call
+func (this *Generator) isBoxedReference(typ *gomodel.Type) bool {
+	if typ.Kind != gomodel.TypeKindInterface || !typ.IsGenericInst() ||
+		typ.GenericType.Name != "*Windows.Foundation.IReference`1" {
+		return false
+	}
+	argType := typ.GenericArgs[0]
+	if rtBoxableStructSet[argType.Name] {
+		return true
+	}
+	wrapperName, ok := rtWrapperTypeMap[this.baseTypeName(argType)]
+	return ok && wrapperName != "Int8" && wrapperName != "*Object"
+}
+
+func (this *Generator) paramTypeName(p *gomodel.Param) string {
+	typ := p.Type
+	if p.ArrayKind == gomodel.ArrayReceive {
+		return "*" + this.baseTypeName(typ)
+	} else if this.isBoxedReference(typ) {
+		return "*" + this.genericArgTypeName(typ.GenericArgs[0])
+	}
+	return this.baseTypeName(typ)
+}
+
+// genericArgTypeName names a type arg of a generic instance, which must implement RtType
+func (this *Generator) genericArgTypeName(typ *gomodel.Type) string {
+	name := this.baseTypeName(typ)
+	if wrapperName, ok := rtWrapperTypeMap[name]; ok {
+		return wrapperName
+	}
+	return name
+}
+
+// genericInstName names a generic instance after its definition and type args,
+// IVector_String for IVector[String]
+func (this *Generator) genericInstName(typ *gomodel.Type) string {
+	if typ.IsGenericInst() {
+		name := this.genericInstName(typ.GenericType)
+		for _, argType := range typ.GenericArgs {
+			name += "_" + this.genericInstName(argType)
+		}
+		return name
+	}
+	name := strings.TrimPrefix(this.genericArgTypeName(typ), "*")
+	return name[strings.LastIndexByte(name, '.')+1:]
+}
+
 func (this *Generator) removeEmbeddedTypeNameSuffix(name string) string {
 	name = strings.ReplaceAll(name, "_e__Union", "")
 	name = strings.ReplaceAll(name, "_e__Struct", "")
@@ -962,15 +1071,11 @@ var builtinTypeSet = map[string]bool{
 	"interface{}": true,
 }
 
-func (this *Generator) _baseTypeName(genType gomodel.GenericType, typeName string) string {
+func (this *Generator) _baseTypeName(typeName string) string {
 	if typeName == "" { //?
 		return ""
 	}
 	var pos int
-	pos = strings.IndexByte(typeName, '[')
-	if pos > 0 {
-		typeName = typeName[:pos]
-	}
 	prefix, typeName0 := typeName, typeName
 	typeName = ""
 	for n, c := range typeName0 {
@@ -980,13 +1085,6 @@ func (this *Generator) _baseTypeName(genType gomodel.GenericType, typeName strin
 			break
 		}
 	}
-	if typeName != "" && typeName[0] == '`' {
-		index, _ := strconv.Atoi(typeName[1:])
-		index -= 1
-		genParams := genType.GetGenericParams()
-		genParam := genParams[index]
-		typeName = genParam
-	}
 	pos = strings.LastIndexByte(typeName, '`')
 	if pos != -1 {
 		typeName = typeName[:pos] //remove gen suffix
@@ -995,8 +1093,12 @@ func (this *Generator) _baseTypeName(genType gomodel.GenericType, typeName strin
 	if pos != -1 {
 		nsName := typeName[:pos]
 		nsName = this.resolveNsName(nsName)
+		goTypeName, renamed := this.typeNameMap[typeName]
 		typeName = typeName[pos+1:]
 		typeName = utils.CapName(typeName)
+		if renamed {
+			typeName = goTypeName
+		}
 		if nsName == this.contextPkgName {
 			//nop
 		} else {
@@ -1038,106 +1140,153 @@ func (this *Generator) nsReplaceImports(imports []string) []string {
 }
 
 func (this *Generator) genClass(class *gomodel.RtClass) string {
-	code := ""
 	className := utils.CapSafeName(class.Name)
-	code += "type " + className + " struct {\n"
-	code += "\tRtClass\n"
 	var defIntfName string
 	if class.DefaultInterface == nil {
 		if !class.Static {
 			log.Panic("?")
 		}
 	} else {
-		defIntfName = this.baseTypeName(class.DefaultInterface, class.DefaultInterface)[1:]
-		code += "\t*" + defIntfName + "\n"
+		defIntfName = this.baseTypeName(class.DefaultInterface)[1:]
 	}
-	code += "}\n\n"
-
 	defIntfFieldName := defIntfName
-	pos := strings.IndexByte(defIntfFieldName, '[')
-	if pos != -1 {
-		defIntfFieldName = defIntfFieldName[:pos]
+	if class.DefaultInterface != nil && class.DefaultInterface.IsGenericInst() {
+		defIntfFieldName = this.baseTypeName(class.DefaultInterface.GenericType)[1:]
 	}
 
-	classId := this.contextPkgName0 + "." + className
+	data := &classData{
+		RtClass:          class,
+		ClassName:        className,
+		ClassId:          this.contextPkgName0 + "." + className,
+		DefIntfName:      defIntfName,
+		DefIntfFieldName: defIntfFieldName,
+	}
 	if class.DirectActivatable {
-		code += "func New" + className + "() *" + className + "{\n"
-		code += "\ths := NewHStr(\"" + classId + "\")\n"
-		code += "\tvar p *win32.IInspectable\n"
-		code += "\thr := win32.RoActivateInstance(hs.Ptr, &p)\n"
-		code += "\tif win32.FAILED(hr) {\n"
-		code += "\t\tlog.Panic(\"?\")\n"
-		code += "\t}\n"
-		code += "\tresult := &" + className + "{\n"
-		code += "\t\tRtClass: RtClass{PInspect:p},\n"
-		code += "\t\t" + defIntfFieldName + ": (*" + defIntfName + ")(unsafe.Pointer(p))}\n"
-		code += "\tcom.AddToScope(result)\n"
-		code += "\treturn result"
-		code += "}\n\n"
-	}
-	facType := class.FactoryType
-	if facType != nil {
-		pos := strings.LastIndexByte(facType.Name, '.')
-		facInterface := this.interfaceMap[facType.Name[pos+1:]]
-
-		for _, facMethod := range facInterface.Methods {
-			code += "func New" + className + "_" + facMethod.Name + "("
-			var pNames []string
-			for m, p := range facMethod.Params {
-				if m > 0 {
-					code += ", "
-				}
-				pName := utils.SafeName(p.Name)
-				pNames = append(pNames, pName)
-				code += pName + " " + this.baseTypeName(nil, p.Type)
-			}
-			code += ") *" + className + "{\n"
-			code += "\ths := NewHStr(\"" + classId + "\")\n"
-			code += "\tvar pFac *" + facInterface.Name + "\n"
-			code += "\thr := win32.RoGetActivationFactory(hs.Ptr, " +
-				"&IID_" + facInterface.Name + ", unsafe.Pointer(&pFac))\n"
-			code += "\tif win32.FAILED(hr) {\n"
-			code += "\t\tlog.Panic(\"?\")\n"
-			code += "\t}\n"
-
-			code += "\tvar p *" + defIntfName + "\n"
-			methodName := utils.CapSafeName(facMethod.Name)
-			code += "\tp = pFac." + methodName + "("
-			for m, pName := range pNames {
-				if m > 0 {
-					code += ", "
-				}
-				code += pName
-			}
-			code += ")\n"
-			code += "\tresult := &" + className + "{\n"
-			code += "\t\tRtClass: RtClass{PInspect:&p.IInspectable},\n"
-			code += "\t\t" + defIntfName + ": p,\n"
-			code += "}\n"
-			code += "\tcom.AddToScope(result)\n"
-			code += "\treturn result"
-			code += "}\n\n"
+		data.Activator = this.factoryGetter(className, data.ClassId,
+			"IActivationFactory", "IID_IActivationFactory")
+	}
+	ctorNameSet := make(map[string]bool)
+	for _, fac := range class.Factories {
+		data.Factories = append(data.Factories, this.classFactory(data, fac, ctorNameSet))
+	}
+	for _, fac := range class.ComposableFactories {
+		if !fac.Public {
+			continue //only usable by derived classes
+		}
+		data.Factories = append(data.Factories, this.classFactory(data, fac, ctorNameSet))
+	}
+
+	asNameSet := make(map[string]bool)
+	for _, intfType := range class.Interfaces {
+		if intfType.IsGenericInst() && intfType.RtSignature == "" {
+			continue //type args without a winrt signature
 		}
+		data.Casts = append(data.Casts, this.interfaceCast(className, intfType, asNameSet))
 	}
 
 	for _, si := range class.StaticInterfaces {
-		code += this.genStaticInterfaceCreator(classId, si)
+		intfName := this.baseTypeName(si)[1:]
+		data.StaticCreators = append(data.StaticCreators, &staticCreatorData{
+			Getter:   this.factoryGetter(className, data.ClassId, intfName, iidVarName(intfName)),
+			IntfName: intfName,
+		})
 	}
+	return this.execTemplate("class", data)
+}
 
-	return code
+func (this *Generator) interfaceCast(className string,
+	intfType *gomodel.Type, asNameSet map[string]bool) *interfaceCastData {
+	intfName := this.baseTypeName(intfType)[1:]
+	if intfType.IsGenericInst() {
+		iidName, ok := this.instIIDNameMap[intfType.RtSignature]
+		if !ok {
+			log.Panic("no iid var for " + intfType.RtSignature)
+		}
+		asName := "As" + this.genericInstName(intfType)
+		if asNameSet[asName] {
+			iid := gomodel.ParameterizedIID(intfType.RtSignature)
+			sIID, _ := win32.GuidToStr(&iid)
+			asName += "_" + sIID[:8]
+		}
+		asNameSet[asName] = true
+		return &interfaceCastData{
+			ClassName: className,
+			AsName:    asName,
+			IntfName:  intfName,
+			IIDName:   iidName,
+		}
+	}
+	asName := "As" + intfName[strings.LastIndexByte(intfName, '.')+1:]
+	if asNameSet[asName] {
+		asName = "As" + strings.ReplaceAll(intfName, ".", "_")
+	}
+	asNameSet[asName] = true
+	return &interfaceCastData{
+		ClassName: className,
+		AsName:    asName,
+		IntfName:  intfName,
+		IIDName:   iidVarName(intfName),
+	}
 }
 
-func (this *Generator) genStaticInterfaceCreator(classId string, intfType *gomodel.Type) string {
-	code := ""
-	intfName := this.baseTypeName(nil, intfType)[1:]
-	code += "func New" + intfName + "() *" + intfName + "{\n"
-	code += "\tvar p *" + intfName + "\n"
-	code += "\ths := NewHStr(\"" + classId + "\")\n"
-	code += "\thr := win32.RoGetActivationFactory(hs.Ptr, " +
-		"&IID_" + intfName + ", unsafe.Pointer(&p))\n"
-	code += "\twin32.ASSERT_SUCCEEDED(hr)\n"
-	code += "\tcom.AddToScope(p)\n"
-	code += "\treturn p\n"
-	code += "}\n\n"
-	return code
+// iidVarName is the name of the IID var of the interface intfName,
+// qualified like it if declared in another package
+func iidVarName(intfName string) string {
+	pos := strings.LastIndexByte(intfName, '.')
+	return intfName[:pos+1] + "IID_" + intfName[pos+1:]
+}
+
+// cached factory getter, the returned factory must not be released
+func (this *Generator) factoryGetter(className string, classId string,
+	facIntfName string, iidName string) *factoryGetterData {
+	shortName := facIntfName[strings.LastIndexByte(facIntfName, '.')+1:]
+	return &factoryGetterData{
+		ClassId:     classId,
+		VarName:     "p" + className + "_" + shortName,
+		GetterName:  "get" + className + "_" + shortName,
+		FacIntfName: facIntfName,
+		IIDName:     iidName,
+	}
+}
+
+func (this *Generator) classFactory(class *classData, fac *gomodel.RtClassFactory,
+	ctorNameSet map[string]bool) *classFactoryData {
+	facInterface := this.interfaceMap[fac.Type.Name]
+	if facInterface == nil {
+		log.Panic("unknown factory interface " + fac.Type.Name)
+	}
+	facIntfName := this.baseTypeName(fac.Type)[1:]
+	data := &classFactoryData{
+		RtClassFactory: fac,
+		Getter: this.factoryGetter(class.ClassName, class.ClassId,
+			facIntfName, iidVarName(facIntfName)),
+	}
+
+	for _, facMethod := range facInterface.Methods {
+		params := facMethod.Params
+		if fac.Composable {
+			//..., baseInterface, out innerInterface
+			if len(params) < 2 {
+				log.Panic("?")
+			}
+			params = params[:len(params)-2]
+		}
+
+		ctorName := "New" + class.ClassName + "_" + facMethod.Name
+		if ctorNameSet[ctorName] {
+			ctorName = "New" + class.ClassName + "_" + facInterface.Name + "_" + facMethod.Name
+		}
+		ctorNameSet[ctorName] = true
+
+		data.Ctors = append(data.Ctors, &factoryCreatorData{
+			RtClassFactory: fac,
+			Method:         facMethod,
+			Params:         params,
+			ClassName:      class.ClassName,
+			CtorName:       ctorName,
+			GetterName:     data.Getter.GetterName,
+			DefIntfName:    class.DefIntfName,
+		})
+	}
+	return data
 }
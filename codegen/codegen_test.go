@@ -0,0 +1,775 @@
+package codegen
+
+import (
+	"bytes"
+	"github.com/zzl/go-winapi-gen/gomodel"
+	"github.com/zzl/go-winapi-gen/internal/apitest"
+	"github.com/zzl/go-winapi-gen/utils"
+	"github.com/zzl/go-winmd/apimodel"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newTestModel() *gomodel.Model {
+	int32Type := &gomodel.Type{
+		Name: "int32",
+		Kind: gomodel.TypeKindPrimitive,
+		Size: gomodel.TypeSize{TotalSize: 4, AlignSize: 4},
+	}
+	uint32Type := &gomodel.Type{
+		Name:     "uint32",
+		Kind:     gomodel.TypeKindPrimitive,
+		Size:     gomodel.TypeSize{TotalSize: 4, AlignSize: 4},
+		Unsigned: true,
+	}
+	pkgA := &gomodel.Package{
+		Name:     "A",
+		FullName: "Test.A",
+		Consts: []*gomodel.Const{
+			{Name: "VALUE", Type: int32Type, Value: int32(1)},
+		},
+		Enums: []*gomodel.Enum{{
+			Name:     "COLOR",
+			BaseType: int32Type,
+			Values: []*gomodel.EnumValue{
+				{Name: "VALUE", Value: int32(2)},
+				{Name: "RED", Value: int32(0)},
+			},
+		}},
+		SysCalls: []*gomodel.SysCall{
+			{LibName: "kernel32", ProcName: "GetTickCount", ReturnType: uint32Type},
+		},
+	}
+	pkgB := &gomodel.Package{
+		Name:     "B",
+		FullName: "Test.B",
+		Consts: []*gomodel.Const{
+			{Name: "VALUE", Type: int32Type, Value: int32(3)},
+		},
+		Enums: []*gomodel.Enum{{
+			Name:     "SHAPE",
+			BaseType: int32Type,
+			Values: []*gomodel.EnumValue{
+				{Name: "RED", Value: int32(1)},
+			},
+		}},
+		Interfaces: []*gomodel.Interface{{
+			Name: "IShape",
+			Type: &gomodel.Type{Name: "*Test.B.IShape", Kind: gomodel.TypeKindInterface},
+			Methods: []*gomodel.Method{
+				{Name: "Draw", ReturnType: &gomodel.Type{Kind: gomodel.TypeKindVoid}},
+			},
+		}},
+	}
+	return &gomodel.Model{Packages: []*gomodel.Package{pkgA, pkgB}}
+}
+
+func genTestOutput(t *testing.T, goModel *gomodel.Model,
+	configure func(generator *Generator)) (map[string][]byte, *Generator) {
+	dir := t.TempDir()
+	generator := NewGenerator(goModel, map[string]string{
+		"Test.*": "test",
+		"Test.B": "test",
+	})
+	generator.OutputDir = dir
+	generator.NsFullNameAsFileName = true
+	generator.GenSupport = true
+	generator.ModulePath = "example.com/output"
+	if configure != nil {
+		configure(generator)
+	}
+	generator.Gen()
+
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(relPath)] = data
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files, generator
+}
+
+// normalizeSpace collapses the alignment whitespace added by gofmt
+func normalizeSpace(code string) string {
+	lines := strings.Split(code, "\n")
+	for n, line := range lines {
+		lines[n] = strings.Join(strings.Fields(line), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestGenDeterministic(t *testing.T) {
+	files, _ := genTestOutput(t, newTestModel(), nil)
+	for n := 0; n < 5; n++ {
+		files2, _ := genTestOutput(t, newTestModel(), func(generator *Generator) {
+			generator.Parallelism = n + 1
+		})
+		if len(files) != len(files2) {
+			t.Fatalf("file count differs: %d != %d", len(files), len(files2))
+		}
+		for name, data := range files {
+			if !bytes.Equal(data, files2[name]) {
+				t.Fatalf("%s differs between runs", name)
+			}
+		}
+	}
+
+	code := normalizeSpace(string(files["test/Test.A.go"]) + string(files["test/Test.B.go"]))
+	for _, decl := range []string{
+		"VALUE int32 = 1", "VALUE_ int32 = 3", "VALUE__ COLOR = 2",
+		"RED COLOR = 0", "RED_ SHAPE = 1",
+	} {
+		if !strings.Contains(code, decl) {
+			t.Errorf("missing %q", decl)
+		}
+	}
+}
+
+func TestGeneratorDefaultsNotShared(t *testing.T) {
+	generator := NewGenerator(newTestModel(), nil)
+	generator.ModuleVersions["github.com/zzl/go-win32api"] = "v9.9.9"
+	generator.ExtPkgPaths["win32"] = "example.com/win32"
+	if DefaultModuleVersions["github.com/zzl/go-win32api"] == "v9.9.9" ||
+		DefaultExtPkgPaths["win32"] == "example.com/win32" {
+		t.Error("generator overrides leaked into the defaults")
+	}
+}
+
+func TestSymbolRenames(t *testing.T) {
+	files, generator := genTestOutput(t, newTestModel(), func(generator *Generator) {
+		generator.SymbolRenameMap = map[string]string{
+			"Test.B.VALUE":       "B_VALUE",
+			"Test.A.COLOR.VALUE": "COLOR_VALUE",
+			"SHAPE":              "Shape",
+		}
+	})
+	code := normalizeSpace(string(files["test/Test.A.go"]) + string(files["test/Test.B.go"]))
+	for _, decl := range []string{
+		"VALUE int32 = 1", "B_VALUE int32 = 3", "COLOR_VALUE COLOR = 2",
+		"type Shape int32", "RED_ Shape = 1",
+	} {
+		if !strings.Contains(code, decl) {
+			t.Errorf("missing %q", decl)
+		}
+	}
+	var report bytes.Buffer
+	generator.WriteCollisionReport(&report)
+	expected := "test: RED -> RED_ (Test.B.SHAPE.RED clashes with Test.A.COLOR.RED)\n"
+	if report.String() != expected {
+		t.Errorf("unexpected collision report %q", report.String())
+	}
+}
+
+func TestSortNsReplaceRules(t *testing.T) {
+	rules := SortNsReplaceRules(map[string]string{
+		"Windows.*":       "winrt",
+		"Windows.Win32.*": "win32",
+		"Windows.UI":      "ui",
+	})
+	var patterns []string
+	for _, rule := range rules {
+		patterns = append(patterns, rule.Pattern)
+	}
+	expected := "Windows.UI,Windows.Win32.*,Windows.*"
+	if strings.Join(patterns, ",") != expected {
+		t.Fatalf("unexpected rule order %v", patterns)
+	}
+
+	generator := NewGeneratorWithRules(&gomodel.Model{}, rules)
+	for nsName, expected := range map[string]string{
+		"Windows.Win32.Foundation": "win32",
+		"Windows.Foundation":       "winrt",
+		"Windows.UI":               "ui",
+		"Other":                    "Other",
+	} {
+		if name := generator.resolveNsName(nsName); name != expected {
+			t.Errorf("resolveNsName(%q) = %q, expected %q", nsName, name, expected)
+		}
+	}
+}
+
+func TestFormatCode(t *testing.T) {
+	generator := NewGenerator(&gomodel.Model{}, nil)
+	generator.usedImportSet = make(map[string]bool)
+	code, err := generator.formatCode("a.go", "package a\n"+
+		"type Catalog struct{ x int }\n"+
+		"func f(c Catalog) int { return int(unsafe.Sizeof(c.x)) }\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(code), "import (\n\t\"unsafe\"\n)") ||
+		strings.Contains(string(code), "\"log\"") {
+		t.Errorf("unexpected imports in\n%s", code)
+	}
+
+	//sync is a param, not the package
+	code, err = generator.formatCode("c.go", "package c\n"+
+		"type Point struct{ X, Y int }\n"+
+		"var points = []Point{Point{1, 2}}\n"+
+		"var refs = map[string]*Point{\"a\": &Point{3, 4}}\n"+
+		"func f(sync Point, s []int) int {\n"+
+		"\tfor n, _ := range s[1:len(s)] {\n\t\t_ = n\n\t}\n"+
+		"\treturn sync.X + int(time.Second)\n}\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"import (\n\t\"time\"\n)", "[]Point{{1, 2}}",
+		"\"a\": {3, 4}", "for n := range s[1:] {"} {
+		if !strings.Contains(string(code), expected) {
+			t.Errorf("%q not found in\n%s", expected, code)
+		}
+	}
+
+	_, err = generator.formatCode("b.go", "package b\n\nfunc f() {\n\treturn 1 +\n}\n", nil)
+	codeErr, ok := err.(*CodeError)
+	if !ok || codeErr.FileName != "b.go" || codeErr.Line != 5 {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestTemplateOverride(t *testing.T) {
+	files, _ := genTestOutput(t, newTestModel(), func(generator *Generator) {
+		generator.TemplateTexts = []string{`{{define "sysCall" -}}
+func {{.FuncName}}() {{baseTypeName .ReturnType}} {
+	ret, _, _ := {{libVarName .LibName}}.NewProc("{{.ProcName}}").Call()
+	return {{genCastFromUintptr .ReturnType "ret"}}
+}
+{{end}}`}
+	})
+	code := string(files["test/Test.A.go"])
+	if !strings.Contains(code, `ret, _, _ := libKernel32.NewProc("GetTickCount").Call()`) ||
+		strings.Contains(code, "lazyAddr") {
+		t.Errorf("sysCall template not overridden:\n%s", code)
+	}
+}
+
+func TestXSysBackend(t *testing.T) {
+	goModel := newTestModel()
+	pkgA := goModel.Packages[0]
+	pkgA.SysCalls = append(pkgA.SysCalls, &gomodel.SysCall{
+		LibName:  "user32",
+		ProcName: "MessageBeep",
+		Params: []*gomodel.Param{{Name: "type", Type: &gomodel.Type{
+			Name: "uint32", Kind: gomodel.TypeKindPrimitive, Size: gomodel.TypeSize{TotalSize: 4, AlignSize: 4},
+		}}},
+		ReturnType:      &gomodel.Type{Kind: gomodel.TypeKindVoid},
+		ReturnLastError: true,
+	})
+	files, _ := genTestOutput(t, goModel, func(generator *Generator) {
+		generator.SysCallBackend = SysCallBackendXSys
+	})
+	code := normalizeSpace(string(files["test/Test.A.go"]))
+	for _, s := range []string{
+		`procGetTickCount = libKernel32.NewProc("GetTickCount")`,
+		"ret, _, _ := procGetTickCount.Call()",
+		"func MessageBeep(type_ uint32) windows.Errno {",
+		"_, _, err := procMessageBeep.Call(uintptr(type_))",
+		"return err.(windows.Errno)",
+	} {
+		if !strings.Contains(code, s) {
+			t.Errorf("missing %q in\n%s", s, code)
+		}
+	}
+	support := string(files["test/support.go"])
+	if strings.Contains(support, "lazyAddr") || !strings.Contains(support, "NewLazySystemDLL") {
+		t.Errorf("unexpected support code\n%s", support)
+	}
+}
+
+func TestFileSplit(t *testing.T) {
+	for _, c := range []struct {
+		split     string
+		fileNames string
+	}{
+		{FileSplitByKind, "Test.A_consts.go,Test.A_enums.go,Test.A_funcs.go," +
+			"Test.B_consts.go,Test.B_enums.go,Test.B_interfaces.go"},
+		{FileSplitBySize, "Test.A.go,Test.A_2.go,Test.A_3.go,Test.A_4.go," +
+			"Test.B.go,Test.B_2.go,Test.B_3.go,Test.B_4.go"},
+		{FileSplitPerType, "Test.A.go,Test.B.go,Test.B_IList.go,Test.B_IShape.go"},
+	} {
+		goModel := newTestModel()
+		pkgB := goModel.Packages[1]
+		pkgB.Interfaces = append(pkgB.Interfaces, &gomodel.Interface{
+			Name: "IList`1",
+			Type: &gomodel.Type{Name: "*Test.B.IList`1", Kind: gomodel.TypeKindInterface,
+				GenericParams: []string{"T"}},
+			Rt: true,
+		})
+		files, _ := genTestOutput(t, goModel, func(generator *Generator) {
+			generator.FileSplit = c.split
+			generator.FileSplitSize = 1
+		})
+		var fileNames []string
+		for name := range files {
+			if strings.HasPrefix(name, "test/Test.") {
+				fileNames = append(fileNames, strings.TrimPrefix(name, "test/"))
+			}
+		}
+		sort.Strings(fileNames)
+		if strings.Join(fileNames, ",") != c.fileNames {
+			t.Errorf("%s: unexpected files %v", c.split, fileNames)
+		}
+	}
+}
+
+func TestClassFactoryInOtherPackage(t *testing.T) {
+	const rtGuidAttr = "Windows.Foundation.Metadata.GuidAttribute"
+	stringType := &apimodel.Type{Kind: apimodel.TypeString, Name: "string", FullName: "string"}
+	widget := &apimodel.Type{Kind: apimodel.TypeClass, Class: true, Name: "Widget"}
+	newFactory := func(data1 uint32, methodName string) *apimodel.Type {
+		return &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IWidgetFactory",
+			Attributes: []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, data1)},
+			InterfaceDef: &apimodel.InterfaceDef{Methods: []*apimodel.Method{
+				{Name: methodName, Params: []*apimodel.Param{apitest.Param("name", stringType)},
+					ReturnType: widget},
+			}}}
+	}
+	//a factory interface of the same name in the class namespace
+	foundationNs := apitest.Ns("Windows.Foundation", newFactory(0x33333333, "CreateInstance"))
+	iwidget := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IWidget",
+		Attributes: []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x22222222)},
+		InterfaceDef: &apimodel.InterfaceDef{Methods: []*apimodel.Method{
+			{Name: "get_Name", ReturnType: stringType}}}}
+	widget.Attributes = []*apimodel.Attribute{
+		apitest.Attr("Windows.Foundation.Metadata.DualApiPartitionAttribute"),
+		apitest.Attr("Windows.Foundation.Metadata.ActivatableAttribute",
+			"Windows.Foundation.IWidgetFactory", uint32(0x10000)),
+	}
+	widget.ClassDef = &apimodel.ClassDef{Implements: []*apimodel.Type{iwidget},
+		DefaultInterface: iwidget}
+	widgetsNs := apitest.Ns("Windows.UI.Widgets", iwidget, newFactory(0x44444444, "CreateOther"), widget)
+	goModel := gomodel.NewModelParser(apitest.Model(foundationNs, widgetsNs), nil, nil).Parse()
+
+	generator := NewGenerator(goModel, map[string]string{
+		"Windows.Foundation": "foundation",
+		"Windows.UI.*":       "widgets",
+	})
+	generator.OutputDir = t.TempDir()
+	generator.NsFullNameAsFileName = true
+	generator.Gen()
+	data, err := os.ReadFile(filepath.Join(generator.OutputDir, "widgets", "Windows.UI.Widgets.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := string(data)
+	for _, s := range []string{"func NewWidget_CreateInstance(name string)",
+		"(*foundation.IWidgetFactory, error)", "&foundation.IID_IWidgetFactory"} {
+		if !strings.Contains(code, s) {
+			t.Errorf("%q not generated:\n%s", s, code)
+		}
+	}
+	if strings.Contains(code, "NewWidget_CreateOther") {
+		t.Errorf("factory of the class namespace used:\n%s", code)
+	}
+}
+
+func TestGenericCastNames(t *testing.T) {
+	const rtGuidAttr = "Windows.Foundation.Metadata.GuidAttribute"
+	stringType := &apimodel.Type{Kind: apimodel.TypeString, Name: "string", FullName: "string"}
+	newVector := func(data1 uint32) *apimodel.Type {
+		return &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IVector`1",
+			Generic: true, GenericDefParams: []string{"T"},
+			Attributes:   []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, data1)},
+			InterfaceDef: &apimodel.InterfaceDef{}}
+	}
+	//generic interfaces of the same name, instantiated with the same type arg
+	ivector, ivector2 := newVector(0x913337e9), newVector(0x55555555)
+	collectionsNs := apitest.Ns("Windows.Foundation.Collections", ivector)
+	iwidget := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IWidget",
+		Attributes:   []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x22222222)},
+		InterfaceDef: &apimodel.InterfaceDef{}}
+	widget := &apimodel.Type{Kind: apimodel.TypeClass, Class: true, Name: "Widget",
+		Attributes: []*apimodel.Attribute{
+			apitest.Attr("Windows.Foundation.Metadata.DualApiPartitionAttribute")}}
+	widgetsNs := apitest.Ns("Windows.UI.Widgets", ivector2, iwidget, widget)
+	widget.ClassDef = &apimodel.ClassDef{Implements: []*apimodel.Type{iwidget,
+		apitest.GenericInst(ivector, stringType), apitest.GenericInst(ivector2, stringType)},
+		DefaultInterface: iwidget}
+	goModel := gomodel.NewModelParser(apitest.Model(collectionsNs, widgetsNs), nil, nil).Parse()
+
+	generator := NewGenerator(goModel, map[string]string{"Windows.*": "winrt"})
+	generator.OutputDir = t.TempDir()
+	generator.NsFullNameAsFileName = true
+	generator.Gen()
+	data, err := os.ReadFile(filepath.Join(generator.OutputDir, "winrt", "Windows.UI.Widgets.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := string(data)
+	if strings.Count(code, "func (this *Widget) AsIVector_String() ") != 1 ||
+		strings.Count(code, "func (this *Widget) AsIVector_String_") != 1 {
+		t.Errorf("unexpected casts:\n%s", code)
+	}
+}
+
+func TestIncrementalGen(t *testing.T) {
+	dir := t.TempDir()
+	gen := func(split string) *Generator {
+		generator := NewGenerator(newTestModel(), map[string]string{"Test.*": "test"})
+		generator.OutputDir = dir
+		generator.NsFullNameAsFileName = true
+		generator.FileSplit = split
+		generator.FileSplitSize = 1
+		generator.Gen()
+		return generator
+	}
+	gen(FileSplitPerType)
+	handWritten := filepath.Join(dir, "test", "extra.go")
+	err := os.WriteFile(handWritten, []byte("package test\n\n"+
+		utils.HandWrittenMarker+"\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written, unchanged, removed := gen(FileSplitPerType).FileStats()
+	if written != 0 || unchanged != 3 || removed != 0 {
+		t.Errorf("rerun: %d written, %d unchanged, %d removed", written, unchanged, removed)
+	}
+
+	//Test.B_IShape.go is no longer generated
+	written, unchanged, removed = gen(FileSplitNone).FileStats()
+	if written != 1 || unchanged != 1 || removed != 1 {
+		t.Errorf("resplit: %d written, %d unchanged, %d removed", written, unchanged, removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test", "Test.B_IShape.go")); !os.IsNotExist(err) {
+		t.Error("stale generated file not removed")
+	}
+	if _, err := os.Stat(handWritten); err != nil {
+		t.Error("hand-written file removed")
+	}
+}
+
+func TestGenWithoutManifest(t *testing.T) {
+	for _, migrate := range []bool{false, true} {
+		dir := t.TempDir()
+		files := map[string]string{
+			"test/Test.Old.go":     generatedCodeLine + "\npackage test\n",
+			"test/Test.Older.go":   "package test\n", //of a version without file headers
+			"test/helper.go":       "package test\n",
+			"test/0_package.go":    "package test\n",
+			"test/extra.go":        "package test\n\n" + utils.HandWrittenMarker + "\n",
+			"test/notes.txt":       "notes\n",
+			".git/HEAD.go":         generatedCodeLine,
+			"other/Test.Other.go":  generatedCodeLine + "\npackage other\n",
+			"other/Test.Marked.go": generatedCodeLine + utils.HandWrittenMarker + "\n",
+		}
+		for relPath, content := range files {
+			filePath := filepath.Join(dir, relPath)
+			err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+			if err == nil {
+				err = os.WriteFile(filePath, []byte(content), 0666)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		generator := NewGenerator(newTestModel(), map[string]string{"Test.*": "test"})
+		generator.OutputDir = dir
+		generator.NsFullNameAsFileName = true
+		generator.MigrateOutput = migrate
+		generator.Gen()
+
+		staleSet := map[string]bool{"test/Test.Old.go": true, "other/Test.Other.go": true}
+		if migrate {
+			staleSet["test/Test.Older.go"] = true
+			staleSet["test/helper.go"] = true
+		}
+		if _, _, removed := generator.FileStats(); removed != len(staleSet) {
+			t.Errorf("migrate %v: %d files removed", migrate, removed)
+		}
+		for relPath := range files {
+			_, err := os.Stat(filepath.Join(dir, relPath))
+			if staleSet[relPath] && !os.IsNotExist(err) {
+				t.Errorf("migrate %v: stale file %s not removed", migrate, relPath)
+			} else if !staleSet[relPath] && err != nil {
+				t.Errorf("migrate %v: file %s removed", migrate, relPath)
+			}
+		}
+	}
+}
+
+func TestSupportSkipsHandWrittenNames(t *testing.T) {
+	dir := t.TempDir()
+	gen := func() {
+		generator := NewGenerator(newTestModel(), map[string]string{"Test.*": "test"})
+		generator.OutputDir = dir
+		generator.GenSupport = true
+		generator.Gen()
+	}
+	gen()
+	//like the 0_package.go of go-win32api, without the marker
+	err := os.WriteFile(filepath.Join(dir, "test", "0_package.go"), []byte("package test\n\n"+
+		"import \"golang.org/x/sys/windows\"\n\n"+
+		"var libKernel32 = windows.NewLazySystemDLL(\"kernel32.dll\")\n\n"+
+		"func lazyAddr(pAddr *uintptr, lib *windows.LazyDLL, procName string) uintptr {\n"+
+		"\treturn 0\n}\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen()
+
+	data, err := os.ReadFile(filepath.Join(dir, "test", SupportFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), SupportFileName, data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameSet := make(map[string]bool)
+	for _, decl := range file.Decls {
+		for _, name := range declNames(decl) {
+			nameSet[name] = true
+		}
+	}
+	if nameSet["libKernel32"] || nameSet["lazyAddr"] {
+		t.Errorf("support file redeclares hand-written names:\n%s", data)
+	}
+	if !nameSet["As"] {
+		t.Errorf("support file lost the other declarations:\n%s", data)
+	}
+}
+
+func TestCheckOnly(t *testing.T) {
+	dir := t.TempDir()
+	gen := func(checkOnly bool) *Generator {
+		generator := NewGenerator(newTestModel(), map[string]string{"Test.*": "test"})
+		generator.OutputDir = dir
+		generator.NsFullNameAsFileName = true
+		generator.CheckOnly = checkOnly
+		generator.Gen()
+		return generator
+	}
+	if drifts := gen(true).Drifts; len(drifts) != 2 || drifts[0].Old != nil {
+		t.Fatalf("empty dir: unexpected drifts %v", drifts)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test")); !os.IsNotExist(err) {
+		t.Fatal("files written in check mode")
+	}
+	gen(false)
+	if drifts := gen(true).Drifts; len(drifts) != 0 {
+		t.Fatalf("up to date dir: unexpected drifts %v", drifts)
+	}
+
+	filePath := filepath.Join(dir, "test", "Test.A.go")
+	data, _ := os.ReadFile(filePath)
+	os.WriteFile(filePath, bytes.Replace(data, []byte("RED "), []byte("REDD "), 1), 0666)
+	generator := gen(true)
+	var sb strings.Builder
+	generator.WriteDriftReport(&sb)
+	report := sb.String()
+	if !strings.HasPrefix(report, "--- a/test/Test.A.go\n+++ b/test/Test.A.go\n@@ ") ||
+		!strings.Contains(report, "\n-\tREDD ") || !strings.Contains(report, "\n+\tRED ") {
+		t.Errorf("unexpected report:\n%s", report)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n"
+	expected := "--- a\n+++ b\n" +
+		"@@ -1,6 +1,6 @@\n 1\n 2\n-3\n+three\n 4\n 5\n 6\n" +
+		"@@ -10,3 +10,4 @@\n 10\n 11\n 12\n+13\n"
+	if diff := unifiedDiff("a", "b", a, b); diff != expected {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+	if diff := unifiedDiff("a", "b", a, a); diff != "" {
+		t.Errorf("diff of equal texts: %s", diff)
+	}
+}
+
+func TestGeneratedHeader(t *testing.T) {
+	mdFilePath := filepath.Join(t.TempDir(), "Test.winmd")
+	os.WriteFile(mdFilePath, []byte("metadata"), 0666)
+	filter := &gomodel.ApiFilter{Namespaces: []string{"Test.*"}}
+	provenance, err := NewProvenance(mdFilePath, "1.0.0.0", filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := genTestOutput(t, newTestModel(), func(generator *Generator) {
+		generator.Provenance = provenance
+	})
+	header := "// Code generated by go-winapi-gen. DO NOT EDIT.\n//\n"
+	mdLine := "// winmd: Test.winmd 1.0.0.0 sha256:" +
+		"45447b7afbd5e544f7d0f1df0fccd26014d9850130abd3f020b89ff96b82079f\n"
+	generatorLine := "// generator: go-winapi-gen " + provenance.GeneratorVersion + "\n"
+	filterLine := "// filter: namespaces Test.*; sha256:" + provenance.FilterHash() + "\n"
+	for name, data := range files {
+		if name == ManifestFileName {
+			if !bytes.Contains(data, []byte(`"Test.*"`)) {
+				t.Errorf("filter missing in manifest:\n%s", data)
+			}
+			continue
+		}
+		if !bytes.HasPrefix(data, []byte(header+generatorLine)) || !bytes.Contains(data, []byte(mdLine)) ||
+			!bytes.Contains(data, []byte(filterLine)) {
+			t.Errorf("%s: unexpected header:\n%s", name, data)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	if testing.Short() {
+		t.Skip("type checks the std library")
+	}
+	//without the support file lazyAddr is undefined
+	_, generator := genTestOutput(t, newTestModel(), func(generator *Generator) {
+		generator.GenSupport = false
+	})
+	typeErrs, err := generator.Verify("amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(typeErrs) != 2 || !strings.Contains(typeErrs[0].Msg, "lazyAddr") {
+		t.Fatalf("unexpected type errors %v", typeErrs)
+	}
+	for _, typeErr := range typeErrs {
+		if typeErr.Origin != "Test.A.GetTickCount" {
+			t.Errorf("unexpected origin of %v", typeErr)
+		}
+	}
+}
+
+// newFuzzType builds a type the way the model parser names them, driven by data
+func newFuzzType(data []byte, depth int) (*gomodel.Type, []byte) {
+	next := func() int {
+		if len(data) == 0 {
+			return 0
+		}
+		b := int(data[0])
+		data = data[1:]
+		return b
+	}
+	var prefix string
+	for n := next() % 3; n > 0; n-- {
+		if next()%2 == 0 {
+			prefix += "*"
+		} else {
+			prefix += "[" + strconv.Itoa(1+next()%8) + "]"
+		}
+	}
+	typ := &gomodel.Type{}
+	switch next() % 7 {
+	case 0:
+		typ.Name = "uint32"
+	case 1:
+		typ.Name = "Test.A.Widget"
+	case 2:
+		typ.Name = "Test.B.Other_Anonymous_e__Union"
+	case 3:
+		genType := &gomodel.Type{Name: "*Test.A.IBox`1", GenericParams: []string{"T", "TResult"}}
+		typ.GenericParamIndex = next() % 2
+		typ.Name = genType.GenericParams[typ.GenericParamIndex]
+		typ.GenericParamOwner = genType
+		if prefix == "" {
+			typ.Kind = gomodel.TypeKindGenericParam
+		}
+	case 4:
+		typ.Name = "*"
+	case 5:
+		typ.Name = "Test.B.IMap`2"
+		for n := 0; n < 2; n++ {
+			var argType *gomodel.Type
+			if depth < 3 {
+				argType, data = newFuzzType(data, depth+1)
+			} else {
+				argType = &gomodel.Type{Name: "string"}
+			}
+			typ.GenericArgs = append(typ.GenericArgs, argType)
+		}
+	default:
+		typ.Name = "*Test.A.IBox`1"
+		typ.GenericArgs = []*gomodel.Type{{Name: "Test.A.Widget"}}
+	}
+	typ.Name = prefix + typ.Name
+	return typ, data
+}
+
+func FuzzBaseTypeName(f *testing.F) {
+	f.Add([]byte{0, 1, 0})
+	f.Add([]byte{1, 0, 0, 3, 2})
+	f.Add([]byte{0, 0, 0, 5, 0, 6, 0, 0, 3, 1})
+	f.Add([]byte{1, 0, 1, 3, 9})
+	f.Add([]byte("0B0000"))
+	generator := NewGenerator(&gomodel.Model{}, map[string]string{"Test.*": "test"})
+	generator.contextPkgName = "test"
+	f.Fuzz(func(t *testing.T, data []byte) {
+		typ, _ := newFuzzType(data, 0)
+		typeName := generator.baseTypeName(typ)
+		if _, err := parser.ParseExpr(typeName); err != nil ||
+			strings.ContainsAny(typeName, "`") {
+			t.Errorf("%s named as %q", typ.Name, typeName)
+		}
+	})
+}
+
+// newBenchModel builds a model of pkgCount packages with win32 like content
+func newBenchModel(pkgCount int) *gomodel.Model {
+	int32Type := &gomodel.Type{
+		Name: "int32",
+		Kind: gomodel.TypeKindPrimitive,
+		Size: gomodel.TypeSize{TotalSize: 4, AlignSize: 4},
+	}
+	goModel := &gomodel.Model{}
+	for n := 0; n < pkgCount; n++ {
+		pkgName := "P" + strconv.Itoa(n)
+		pkg := &gomodel.Package{Name: pkgName, FullName: "Bench." + pkgName}
+		for m := 0; m < 500; m++ {
+			name := pkgName + "_" + strconv.Itoa(m)
+			pkg.Consts = append(pkg.Consts, &gomodel.Const{
+				Name: "C_" + name, Type: int32Type, Value: int32(m)})
+			param := &gomodel.Param{Name: "value", Type: int32Type}
+			if m%5 == 0 {
+				pkg.Structs = append(pkg.Structs, &gomodel.Struct{
+					Name:   "S_" + name,
+					Fields: []*gomodel.Field{{Name: "a", Type: int32Type}, {Name: "b", Type: int32Type}},
+				})
+				pkg.SysCalls = append(pkg.SysCalls, &gomodel.SysCall{
+					LibName: "kernel32", ProcName: "F_" + name,
+					Params: []*gomodel.Param{param}, ReturnType: int32Type,
+				})
+			}
+			if m%20 == 0 {
+				pkg.Interfaces = append(pkg.Interfaces, &gomodel.Interface{
+					Name: "I_" + name,
+					Type: &gomodel.Type{Name: "*Bench." + pkgName + ".I_" + name,
+						Kind: gomodel.TypeKindInterface},
+					Methods: []*gomodel.Method{
+						{Name: "Get", Params: []*gomodel.Param{param}, ReturnType: int32Type},
+						{Name: "Set", Params: []*gomodel.Param{param}, ReturnType: int32Type},
+					},
+				})
+			}
+		}
+		goModel.Packages = append(goModel.Packages, pkg)
+	}
+	return goModel
+}
+
+func BenchmarkGen(b *testing.B) {
+	goModel := newBenchModel(32)
+	for n := 0; n < b.N; n++ {
+		generator := NewGenerator(goModel, map[string]string{"Bench.*": "bench"})
+		generator.OutputDir = b.TempDir()
+		generator.NsFullNameAsFileName = true
+		generator.GenSupport = true
+		generator.Gen()
+	}
+}
@@ -0,0 +1,174 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContextLines = 3
+
+// beyond this many edits a file is reported as replaced as a whole
+const maxDiffEdits = 2000
+
+type diffOp struct {
+	kind   byte //' ', '-' or '+'
+	aIndex int  //line index in a before the op
+	bIndex int  //line index in b before the op
+	line   string
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes the shortest edit script from a to b (Myers' algorithm)
+func diffLines(a, b []string) []*diffOp {
+	n, m := len(a), len(b)
+	var trace [][]int
+	found := false
+	for d := 0; d <= n+m && !found; d++ {
+		if d > maxDiffEdits {
+			break
+		}
+		prev := func(k int) int {
+			if d == 0 {
+				return 0
+			}
+			return trace[d-1][k+d-1]
+		}
+		v := make([]int, 2*d+1)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && prev(k-1) < prev(k+1)) {
+				x = prev(k + 1)
+			} else {
+				x = prev(k-1) + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+d] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		trace = append(trace, v)
+	}
+
+	var ops []*diffOp
+	if !found {
+		for y := m - 1; y >= 0; y-- {
+			ops = append(ops, &diffOp{'+', n, y, b[y]})
+		}
+		for x := n - 1; x >= 0; x-- {
+			ops = append(ops, &diffOp{'-', x, 0, a[x]})
+		}
+	} else {
+		x, y := n, m
+		for d := len(trace) - 1; d > 0; d-- {
+			k := x - y
+			get := func(k int) int {
+				return trace[d-1][k+d-1]
+			}
+			var prevK int
+			if k == -d || (k != d && get(k-1) < get(k+1)) {
+				prevK = k + 1
+			} else {
+				prevK = k - 1
+			}
+			prevX := get(prevK)
+			prevY := prevX - prevK
+			for x > prevX && y > prevY {
+				x--
+				y--
+				ops = append(ops, &diffOp{' ', x, y, a[x]})
+			}
+			if x == prevX {
+				y--
+				ops = append(ops, &diffOp{'+', x, y, b[y]})
+			} else {
+				x--
+				ops = append(ops, &diffOp{'-', x, y, a[x]})
+			}
+		}
+		for x > 0 && y > 0 {
+			x--
+			y--
+			ops = append(ops, &diffOp{' ', x, y, a[x]})
+		}
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// unifiedDiff formats the differences of two texts as a unified diff, "" if equal
+func unifiedDiff(aName, bName, aText, bText string) string {
+	if aText == bText {
+		return ""
+	}
+	ops := diffLines(splitLines(aText), splitLines(bText))
+	var sb strings.Builder
+	sb.WriteString("--- " + aName + "\n")
+	sb.WriteString("+++ " + bName + "\n")
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := i - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		lastChange := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				lastChange = j
+			} else if j-lastChange > 2*diffContextLines {
+				break
+			}
+		}
+		end := lastChange + diffContextLines + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		aStart, bStart := ops[start].aIndex, ops[start].bIndex
+		aLen, bLen := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		sb.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen))
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return sb.String()
+}
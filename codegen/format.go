@@ -0,0 +1,260 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// packages the generated code may reference, by logical import name
+var stdImports = []string{
+	"crypto/sha1", "encoding/binary", "errors", "fmt", "log", "math", "reflect",
+	"sync", "sync/atomic", "syscall", "time", "unicode/utf16", "unsafe",
+}
+
+// CodeError reports generated code that failed to parse
+type CodeError struct {
+	FileName string
+	Line     int
+	Msg      string
+	Source   string
+}
+
+func (this *CodeError) Error() string {
+	return fmt.Sprintf("%s:%d: %s\n\t%s", this.FileName, this.Line, this.Msg, this.Source)
+}
+
+func newCodeError(fileName string, code string, line int, msg string) *CodeError {
+	lines := strings.Split(code, "\n")
+	var source string
+	if line > 0 && line <= len(lines) {
+		source = strings.TrimSpace(lines[line-1])
+	}
+	return &CodeError{FileName: fileName, Line: line, Msg: msg, Source: source}
+}
+
+// formatCode parses the code of a file, adds the imports of the packages it
+// actually references, simplifies it like gofmt -s and formats it. nsImports are
+// the ns packages the file may reference besides the std and external ones.
+func (this *Generator) formatCode(fileName string, code string, nsImports []string) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, fileName, code,
+		parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		if errList, ok := err.(scanner.ErrorList); ok && len(errList) > 0 {
+			return nil, newCodeError(fileName, code, errList[0].Pos.Line, errList[0].Msg)
+		}
+		return nil, err
+	}
+
+	candidateMap := make(map[string]string)
+	for _, imp := range stdImports {
+		candidateMap[path.Base(imp)] = imp
+	}
+	for name := range this.ExtPkgPaths {
+		candidateMap[path.Base(name)] = name
+	}
+	for _, imp := range nsImports {
+		candidateMap[this.basePkgName(imp)] = imp
+	}
+	delete(candidateMap, file.Name.Name)
+
+	var imports []string
+	for name := range referencedPkgNames(file, candidateMap) {
+		imports = append(imports, candidateMap[name])
+	}
+	sort.Slice(imports, func(i, j int) bool {
+		return this.importPath(imports[i]) < this.importPath(imports[j])
+	})
+	this.addImportDecl(file, imports)
+	simplifyFile(file)
+
+	var buf bytes.Buffer
+	err = format.Node(&buf, fset, file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return append([]byte(this.genHeaderCode()), buf.Bytes()...), nil
+}
+
+// addImportDecl inserts the import declaration of imports after the package clause
+func (this *Generator) addImportDecl(file *ast.File, imports []string) {
+	if len(imports) == 0 {
+		return
+	}
+	pos := file.Name.End()
+	decl := &ast.GenDecl{TokPos: pos, Tok: token.IMPORT, Lparen: pos, Rparen: pos}
+	for _, imp := range imports {
+		if !this.ownNsSet[imp] {
+			this.usedImportSet[this.importPath(imp)] = true
+		}
+		spec := &ast.ImportSpec{Path: &ast.BasicLit{ValuePos: pos, Kind: token.STRING,
+			Value: strconv.Quote(this.importPath(imp))}}
+		decl.Specs = append(decl.Specs, spec)
+		file.Imports = append(file.Imports, spec)
+	}
+	file.Decls = append([]ast.Decl{decl}, file.Decls...)
+}
+
+// referencedPkgNames collects the names in candidateMap used as the package of a selector,
+// skipping the names a function declares locally
+func referencedPkgNames(file *ast.File, candidateMap map[string]string) map[string]bool {
+	nameSet := make(map[string]bool)
+	var visit func(node ast.Node, localSet map[string]bool)
+	visit = func(node ast.Node, localSet map[string]bool) {
+		ast.Inspect(node, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.FuncDecl:
+				if localSet == nil {
+					visit(node.Type, nil)
+					if node.Body != nil {
+						visit(node.Body, funcLocalNames(node.Recv, node.Type, node.Body))
+					}
+					return false
+				}
+			case *ast.SelectorExpr:
+				ident, ok := node.X.(*ast.Ident)
+				if ok && !localSet[ident.Name] {
+					if _, ok := candidateMap[ident.Name]; ok {
+						nameSet[ident.Name] = true
+					}
+				}
+			}
+			return true
+		})
+	}
+	visit(file, nil)
+	return nameSet
+}
+
+// funcLocalNames collects the names declared by the receiver, params and body of a function
+func funcLocalNames(recv *ast.FieldList, funcType *ast.FuncType, body *ast.BlockStmt) map[string]bool {
+	localSet := make(map[string]bool)
+	addFields := func(fieldList *ast.FieldList) {
+		if fieldList == nil {
+			return
+		}
+		for _, field := range fieldList.List {
+			for _, name := range field.Names {
+				localSet[name.Name] = true
+			}
+		}
+	}
+	addFields(recv)
+	addFields(funcType.Params)
+	addFields(funcType.Results)
+	addIdent := func(expr ast.Expr) {
+		if ident, ok := expr.(*ast.Ident); ok {
+			localSet[ident.Name] = true
+		}
+	}
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.AssignStmt:
+			if node.Tok == token.DEFINE {
+				for _, expr := range node.Lhs {
+					addIdent(expr)
+				}
+			}
+		case *ast.RangeStmt:
+			if node.Tok == token.DEFINE {
+				addIdent(node.Key)
+				addIdent(node.Value)
+			}
+		case *ast.ValueSpec:
+			for _, name := range node.Names {
+				localSet[name.Name] = true
+			}
+		case *ast.FuncLit:
+			addFields(node.Type.Params)
+			addFields(node.Type.Results)
+		}
+		return true
+	})
+	return localSet
+}
+
+// simplifyFile applies the gofmt -s simplifications: composite literal types
+// implied by the outer literal, s[a:len(s)] slices and blank range variables
+func simplifyFile(file *ast.File) {
+	ast.Inspect(file, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.CompositeLit:
+			var keyType, eltType ast.Expr
+			switch typ := node.Type.(type) {
+			case *ast.ArrayType:
+				eltType = typ.Elt
+			case *ast.MapType:
+				keyType, eltType = typ.Key, typ.Value
+			}
+			if eltType == nil {
+				break
+			}
+			for n, elt := range node.Elts {
+				if kv, ok := elt.(*ast.KeyValueExpr); ok {
+					if keyType != nil {
+						kv.Key = simplifyLiteral(keyType, kv.Key)
+					}
+					kv.Value = simplifyLiteral(eltType, kv.Value)
+				} else {
+					node.Elts[n] = simplifyLiteral(eltType, elt)
+				}
+			}
+		case *ast.SliceExpr:
+			if node.Max != nil {
+				break
+			}
+			x, ok := node.X.(*ast.Ident)
+			call, ok2 := node.High.(*ast.CallExpr)
+			if !ok || !ok2 || len(call.Args) != 1 || call.Ellipsis.IsValid() {
+				break
+			}
+			fun, ok := call.Fun.(*ast.Ident)
+			arg, ok2 := call.Args[0].(*ast.Ident)
+			if ok && ok2 && fun.Name == "len" && arg.Name == x.Name {
+				node.High = nil
+			}
+		case *ast.RangeStmt:
+			if isBlankIdent(node.Value) {
+				node.Value = nil
+			}
+			if isBlankIdent(node.Key) && node.Value == nil {
+				node.Key = nil
+			}
+		}
+		return true
+	})
+}
+
+// simplifyLiteral drops the type of an element literal when it is the element type,
+// &T{} elements of *T become {}
+func simplifyLiteral(eltType ast.Expr, x ast.Expr) ast.Expr {
+	if lit, ok := x.(*ast.CompositeLit); ok && lit.Type != nil &&
+		types.ExprString(lit.Type) == types.ExprString(eltType) {
+		lit.Type = nil
+	}
+	if ptr, ok := eltType.(*ast.StarExpr); ok {
+		if addr, ok := x.(*ast.UnaryExpr); ok && addr.Op == token.AND {
+			if lit, ok := addr.X.(*ast.CompositeLit); ok && lit.Type != nil &&
+				types.ExprString(lit.Type) == types.ExprString(ptr.X) {
+				lit.Type = nil
+				return lit
+			}
+		}
+	}
+	return x
+}
+
+func isBlankIdent(expr ast.Expr) bool {
+	ident, ok := expr.(*ast.Ident)
+	return ok && ident.Name == "_"
+}
@@ -0,0 +1,528 @@
+package codegen
+
+import (
+	"bytes"
+	"flag"
+	"github.com/zzl/go-winapi-gen/gomodel"
+	"github.com/zzl/go-winapi-gen/internal/apitest"
+	"github.com/zzl/go-winmd/apimodel"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata/golden")
+
+const goldenDir = "testdata/golden"
+
+// goldenFixture is a synthetic metadata model run through the model parser and the generator
+type goldenFixture struct {
+	name         string
+	buildModel   func() *apimodel.Model
+	nsReplaceMap map[string]string
+	configure    func(generator *Generator)
+	handWritten  map[string]string //files in the output dir before Gen, not golden
+}
+
+var goldenFixtures = []*goldenFixture{
+	{
+		name:         "win32",
+		buildModel:   newWin32ApiModel,
+		nsReplaceMap: map[string]string{"Windows.Win32.*": "win32"},
+		configure: func(generator *Generator) {
+			generator.ModulePath = "example.com/win32api"
+			generator.FileNamePrefixToStrip = "Windows.Win32."
+			generator.PrefixEnumValuesWithTypeName = false
+		},
+		//like the hand-written files of go-win32api
+		handWritten: map[string]string{
+			"win32/1_supplement.go": "package win32\n\nfunc FAILED(hr HRESULT) bool {\n\treturn hr < 0\n}\n",
+		},
+	},
+	{
+		name:         "winrt",
+		buildModel:   newWinRtApiModel,
+		nsReplaceMap: map[string]string{"Windows.*": "winrt"},
+		configure: func(generator *Generator) {
+			generator.ModulePath = "example.com/winrtapi"
+			generator.FileNamePrefixToStrip = "Windows."
+			generator.PrefixEnumValuesWithTypeName = true
+		},
+	},
+}
+
+func TestGolden(t *testing.T) {
+	for _, fixture := range goldenFixtures {
+		t.Run(fixture.name, func(t *testing.T) {
+			files, generator := genGoldenOutput(t, fixture)
+			dir := filepath.Join(goldenDir, fixture.name)
+			if *updateGolden {
+				writeGoldenFiles(t, dir, files)
+				return
+			}
+			goldenFiles := readGoldenFiles(t, dir)
+			for name, data := range files {
+				golden, ok := goldenFiles[name]
+				if !ok {
+					t.Errorf("%s: no golden file, run with -update", name)
+				} else if !bytes.Equal(data, golden) {
+					t.Errorf("%s differs from the golden file, run with -update\n%s", name,
+						unifiedDiff("golden/"+name, name, string(golden), string(data)))
+				}
+			}
+			for name := range goldenFiles {
+				if _, ok := files[name]; !ok {
+					t.Errorf("%s: golden file not generated", name)
+				}
+			}
+			if testing.Short() {
+				return
+			}
+			if missingPaths := missingModules(t, generator.OutputDir); len(missingPaths) != 0 {
+				t.Skip("not type checked, modules missing in the module cache: " +
+					strings.Join(missingPaths, ", "))
+			}
+			typeErrs, err := generator.Verify("amd64")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, typeErr := range typeErrs {
+				t.Error(typeErr)
+			}
+		})
+	}
+}
+
+// rtEntryTestCode runs in the generated winrt package with a fake IWidget,
+// the entry returned by Get_Entry is used after the abi struct was released
+const rtEntryTestCode = `package winrt
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestGetEntry(t *testing.T) {
+	var vtbl IWidgetVtbl
+	vtbl.Get_Entry = syscall.NewCallback(func(this uintptr, pEntry *WidgetEntry) uintptr {
+		wsz, _ := syscall.UTF16FromString("entry")
+		pEntry.Index = 7
+		return uintptr(WindowsCreateString(&wsz[0], uint32(len(wsz)-1), &pEntry.Info.Name))
+	})
+	widget := &IWidget{}
+	widget.LpVtbl = (*[1024]uintptr)(unsafe.Pointer(&vtbl))
+	entry := widget.Get_Entry()
+	runtime.GC()
+	if entry.Index != 7 || entry.Info.Name != "entry" {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+}
+`
+
+func TestRtStructResult(t *testing.T) {
+	if runtime.GOOS != "windows" || testing.Short() {
+		t.Skip("runs the generated winrt code")
+	}
+	_, generator := genGoldenOutput(t, goldenFixtures[1])
+	if missingPaths := missingModules(t, generator.OutputDir); len(missingPaths) != 0 {
+		t.Skip("modules missing in the module cache: " + strings.Join(missingPaths, ", "))
+	}
+	err := os.WriteFile(filepath.Join(generator.OutputDir, "winrt", "entry_test.go"),
+		[]byte(rtEntryTestCode), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "test", "./winrt/")
+	cmd.Dir = generator.OutputDir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+}
+
+func genGoldenOutput(t *testing.T, fixture *goldenFixture) (map[string][]byte, *Generator) {
+	modelParser := gomodel.NewModelParser(fixture.buildModel(), nil, map[string]*gomodel.Type{
+		"System.Guid": gomodel.TypeGuid,
+	})
+	goModel := modelParser.Parse()
+
+	dir := t.TempDir()
+	for relPath, content := range fixture.handWritten {
+		filePath := filepath.Join(dir, filepath.FromSlash(relPath))
+		err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+		if err == nil {
+			err = os.WriteFile(filePath, []byte(content), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	generator := NewGenerator(goModel, fixture.nsReplaceMap)
+	generator.OutputDir = dir
+	generator.NsFullNameAsFileName = true
+	generator.GenSupport = true
+	fixture.configure(generator)
+	generator.Gen()
+
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == ManifestFileName {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(dir, path)
+		if _, ok := fixture.handWritten[filepath.ToSlash(relPath)]; !ok {
+			files[filepath.ToSlash(relPath)] = data
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files, generator
+}
+
+// missingModules lists the modules required by the output in dir which are not downloaded,
+// go-com is required by the winrt output but not by the generator
+func missingModules(t *testing.T, dir string) []string {
+	cmd := exec.Command("go", "list", "-e", "-m", "-f", "{{if not .Main}}{{.Path}} {{.Dir}}{{end}}", "all")
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 1 {
+			paths = append(paths, fields[0])
+		}
+	}
+	return paths
+}
+
+// golden files are stored with a .golden suffix to keep them out of go tooling
+func readGoldenFiles(t *testing.T, dir string) map[string][]byte {
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(dir, path)
+		files[strings.TrimSuffix(filepath.ToSlash(relPath), ".golden")] = data
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func writeGoldenFiles(t *testing.T, dir string, files map[string][]byte) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		filePath := filepath.Join(dir, filepath.FromSlash(name)+".golden")
+		err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+		if err == nil {
+			err = os.WriteFile(filePath, files[name], 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// apimodel fixture helpers
+
+func newApiGuidAttr(fullName string, data1 uint32) *apimodel.Attribute {
+	return apitest.Attr(fullName, data1, uint16(0x1234), uint16(0x5678),
+		uint8(0x9a), uint8(0xbc), uint8(0xde), uint8(0xf0), uint8(1), uint8(2), uint8(3), uint8(4))
+}
+
+// System.Guid as replaced by the apimodel parser of the generator commands
+var apiGuid = &apimodel.Type{Kind: apimodel.TypeStruct, Struct: true,
+	Name: "GUID", FullName: "syscall.GUID", SiezInfo: &apimodel.SizeInfo{Total: 16, Align: 4}}
+
+func newWin32ApiModel() *apimodel.Model {
+	int32Type, uint32Type := apitest.Prim("int32", 4, false), apitest.Prim("uint32", 4, true)
+	uint16Type, uintptrType := apitest.Prim("uint16", 2, true), apitest.Prim("uintptr", 8, true)
+
+	handle := &apimodel.Type{Kind: apimodel.TypeAlias, Alias: true, Name: "HANDLE",
+		AliasType: uintptrType}
+	boolType := &apimodel.Type{Kind: apimodel.TypeAlias, Alias: true, Name: "BOOL",
+		AliasType: int32Type}
+	hresult := &apimodel.Type{Kind: apimodel.TypeAlias, Alias: true, Name: "HRESULT",
+		AliasType: int32Type}
+	pwstr := &apimodel.Type{Kind: apimodel.TypeAlias, Alias: true, Name: "PWSTR",
+		AliasType: apitest.Ptr(uint16Type)}
+	rect := &apimodel.Type{Kind: apimodel.TypeStruct, Struct: true, Name: "RECT",
+		StructDef: &apimodel.StructDef{Fields: apitest.Fields(
+			"left", int32Type, "top", int32Type, "right", int32Type, "bottom", int32Type)}}
+	iunknown := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IUnknown",
+		Attributes: []*apimodel.Attribute{
+			newApiGuidAttr("Windows.Win32.Interop.GuidAttribute", 0x00000000)},
+		InterfaceDef: &apimodel.InterfaceDef{}}
+	iunknown.InterfaceDef.Methods = []*apimodel.Method{
+		{Name: "QueryInterface", Params: []*apimodel.Param{
+			apitest.Param("riid", apitest.Ptr(apiGuid)),
+			apitest.OutParam("ppvObject", apitest.Ptr(apitest.Ptr(apitest.Void)))},
+			ReturnType: hresult},
+		{Name: "AddRef", ReturnType: uint32Type},
+		{Name: "Release", ReturnType: uint32Type},
+	}
+	win32Error := &apimodel.Type{Kind: apimodel.TypeEnum, Enum: true, Name: "WIN32_ERROR",
+		EnumDef: &apimodel.EnumDef{BaseType: uint32Type, Values: []*apimodel.Constant{
+			{Name: "NO_ERROR", Type: uint32Type, Value: uint32(0)},
+		}}}
+	foundationNs := apitest.Ns("Windows.Win32.Foundation", handle, boolType, hresult, pwstr, rect,
+		iunknown, win32Error)
+
+	flags := &apimodel.Type{Kind: apimodel.TypeEnum, Enum: true, Name: "WIDGET_FLAGS",
+		EnumDef: &apimodel.EnumDef{BaseType: uint32Type, Flags: true, Values: []*apimodel.Constant{
+			{Name: "WF_NONE", Type: uint32Type, Value: uint32(0)},
+			{Name: "WF_VISIBLE", Type: uint32Type, Value: uint32(1)},
+			{Name: "WF_ENABLED", Type: uint32Type, Value: uint32(2)},
+		}}}
+	union := &apimodel.Type{Kind: apimodel.TypeUnion, Union: true, Name: "_Anonymous_e__Union",
+		UnionDef: &apimodel.UnionDef{Fields: apitest.Fields(
+			"Value", int32Type, "Handle", handle, "Chars", apitest.Array(uint16Type, 4))}}
+	info := &apimodel.Type{Kind: apimodel.TypeStruct, Struct: true, Name: "WIDGET_INFO",
+		NestedTypes: []*apimodel.Type{union},
+		StructDef: &apimodel.StructDef{Fields: apitest.Fields(
+			"cbSize", uint32Type, "flags", flags, "bounds", rect, "Anonymous", union)}}
+	union.EnclosingType = info
+	widgetProc := &apimodel.Type{Kind: apimodel.TypeFunction, Func: true, Name: "WIDGETPROC",
+		FuncDef: &apimodel.FuncDef{Name: "WIDGETPROC", Params: []*apimodel.Param{
+			apitest.Param("hWidget", handle), apitest.Param("msg", uint32Type)},
+			ReturnType: int32Type}}
+	iwidget := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IWidget",
+		Attributes: []*apimodel.Attribute{
+			newApiGuidAttr("Windows.Win32.Interop.GuidAttribute", 0x11111111)},
+		InterfaceDef: &apimodel.InterfaceDef{Extends: []*apimodel.Type{iunknown}}}
+	iwidget.InterfaceDef.Methods = []*apimodel.Method{
+		{Name: "GetInfo", Params: []*apimodel.Param{
+			apitest.OutParam("pInfo", apitest.Ptr(info))}, ReturnType: int32Type},
+		{Name: "SetBounds", Params: []*apimodel.Param{
+			apitest.Param("bounds", rect)}, ReturnType: int32Type},
+		{Name: "GetParent", Params: []*apimodel.Param{
+			apitest.OutParam("ppParent", apitest.Ptr(iwidget))}, ReturnType: int32Type},
+	}
+	apis := &apimodel.Type{Kind: apimodel.TypePseudo, Pseudo: true, Name: "Apis",
+		PseudoDef: &apimodel.PseudoDef{
+			Constants: []*apimodel.Constant{
+				{Name: "MAX_WIDGETS", Type: uint32Type, Value: uint32(64)},
+				{Name: "WIDGET_CLASS", Type: &apimodel.Type{Kind: apimodel.TypeString,
+					Name: "string", FullName: "string"}, Value: "Widget"},
+			},
+			Methods: []*apimodel.Method{
+				{Name: "CreateWidgetW", SysCall: true, SysCallName: "CreateWidgetW",
+					SysCallDll: "USER32.dll", SysCallSetLastError: true,
+					Params: []*apimodel.Param{
+						apitest.Param("lpName", pwstr), apitest.Param("lpRect", apitest.Ptr(rect)),
+						apitest.Param("lpfnProc", widgetProc)},
+					ReturnType: handle},
+				{Name: "DestroyWidget", SysCall: true, SysCallName: "DestroyWidget",
+					SysCallDll: "USER32.dll", Params: []*apimodel.Param{apitest.Param("hWidget", handle)},
+					ReturnType: boolType},
+				{Name: "GetWidgetCount", SysCall: true, SysCallName: "GetWidgetCount",
+					SysCallDll: "KERNEL32.dll", ReturnType: uint32Type},
+			},
+		}}
+	testNs := apitest.Ns("Windows.Win32.UI.Widgets", flags, info, widgetProc, iwidget, apis)
+	return apitest.Model(foundationNs, testNs)
+}
+
+func newWinRtApiModel() *apimodel.Model {
+	int32Type, uint32Type := apitest.Prim("int32", 4, false), apitest.Prim("uint32", 4, true)
+	int64Type, float32Type := apitest.Prim("int64", 8, false), apitest.Prim("float32", 4, false)
+	boolType := apitest.Prim("bool", 1, false)
+	stringType := &apimodel.Type{Kind: apimodel.TypeString, Name: "string", FullName: "string"}
+	const rtGuidAttr = "Windows.Foundation.Metadata.GuidAttribute"
+
+	point := &apimodel.Type{Kind: apimodel.TypeStruct, Struct: true, Name: "Point",
+		StructDef: &apimodel.StructDef{Fields: apitest.Fields("X", float32Type, "Y", float32Type)}}
+	token := &apimodel.Type{Kind: apimodel.TypeStruct, Struct: true, Name: "EventRegistrationToken",
+		StructDef: &apimodel.StructDef{Fields: apitest.Fields("Value", int64Type)}}
+	iclosable := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IClosable",
+		Attributes: []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x30d5a829)},
+		InterfaceDef: &apimodel.InterfaceDef{Methods: []*apimodel.Method{
+			{Name: "Close", ReturnType: apitest.Void}}}}
+	handler := &apimodel.Type{Kind: apimodel.TypeFunction, Func: true, Name: "TypedEventHandler`2",
+		Generic: true, GenericDefParams: []string{"TSender", "TResult"},
+		Attributes: []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x9de1c534)},
+		FuncDef: &apimodel.FuncDef{Name: "TypedEventHandler`2", Params: []*apimodel.Param{
+			apitest.Param("sender", apitest.GenericParam(0)), apitest.Param("args", apitest.GenericParam(1))},
+			ReturnType: apitest.Void}}
+	handler.FuncDef.Attributes = handler.Attributes
+	deferralHandler := &apimodel.Type{Kind: apimodel.TypeFunction, Func: true,
+		Name: "DeferralCompletedHandler", Attributes: []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0xed32a372)},
+		FuncDef: &apimodel.FuncDef{Name: "DeferralCompletedHandler", ReturnType: apitest.Void}}
+	deferralHandler.FuncDef.Attributes = deferralHandler.Attributes
+	ireference := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IReference`1",
+		Generic: true, GenericDefParams: []string{"T"},
+		Attributes: []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x61c17706)},
+		InterfaceDef: &apimodel.InterfaceDef{Methods: []*apimodel.Method{
+			{Name: "get_Value", ReturnType: apitest.GenericParam(0)}}}}
+	foundationNs := apitest.Ns("Windows.Foundation", point, token, iclosable, handler, deferralHandler,
+		ireference)
+
+	ivector := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IVector`1",
+		Generic: true, GenericDefParams: []string{"T"},
+		Attributes: []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x913337e9)},
+		InterfaceDef: &apimodel.InterfaceDef{Methods: []*apimodel.Method{
+			{Name: "GetAt", Params: []*apimodel.Param{apitest.Param("index", uint32Type)},
+				ReturnType: apitest.GenericParam(0)},
+			{Name: "get_Size", ReturnType: uint32Type},
+			{Name: "Append", Params: []*apimodel.Param{apitest.Param("value", apitest.GenericParam(0))},
+				ReturnType: apitest.Void},
+			{Name: "GetMany", Params: []*apimodel.Param{apitest.Param("startIndex", uint32Type),
+				apitest.OutParam("items", apitest.Array(apitest.GenericParam(0)))}, ReturnType: uint32Type},
+			{Name: "ReplaceAll", Params: []*apimodel.Param{
+				apitest.Param("items", apitest.Array(apitest.GenericParam(0)))}, ReturnType: apitest.Void},
+		}}}
+	ikeyValuePair := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true,
+		Name: "IKeyValuePair`2", Generic: true, GenericDefParams: []string{"K", "V"},
+		Attributes: []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x02b51929)},
+		InterfaceDef: &apimodel.InterfaceDef{Methods: []*apimodel.Method{
+			{Name: "get_Key", ReturnType: apitest.GenericParam(0)},
+			{Name: "get_Value", ReturnType: apitest.GenericParam(1)},
+		}}}
+	imap := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IMap`2",
+		Generic: true, GenericDefParams: []string{"K", "V"},
+		Attributes: []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x3c2925fe)},
+		InterfaceDef: &apimodel.InterfaceDef{Methods: []*apimodel.Method{
+			{Name: "Lookup", Params: []*apimodel.Param{apitest.Param("key", apitest.GenericParam(0))},
+				ReturnType: apitest.GenericParam(1)},
+		}}}
+	collectionsNs := apitest.Ns("Windows.Foundation.Collections", ivector, ikeyValuePair, imap)
+
+	kind := &apimodel.Type{Kind: apimodel.TypeEnum, Enum: true, Name: "WidgetKind",
+		EnumDef: &apimodel.EnumDef{BaseType: int32Type, Values: []*apimodel.Constant{
+			{Name: "Button", Type: int32Type, Value: int32(0)},
+			{Name: "Label", Type: int32Type, Value: int32(1)},
+		}}}
+	layout := &apimodel.Type{Kind: apimodel.TypeStruct, Struct: true, Name: "WidgetLayout",
+		StructDef: &apimodel.StructDef{Fields: apitest.Fields(
+			"Origin", point, "Kind", kind, "Visible", boolType)}}
+	// structs owning references, directly and through a nested struct
+	info := &apimodel.Type{Kind: apimodel.TypeStruct, Struct: true, Name: "WidgetInfo",
+		StructDef: &apimodel.StructDef{Fields: apitest.Fields("Name", stringType,
+			"ItemCount", apitest.GenericInst(ireference, apitest.Prim("uint64", 8, true)),
+			"Layout", layout)}}
+	entry := &apimodel.Type{Kind: apimodel.TypeStruct, Struct: true, Name: "WidgetEntry",
+		StructDef: &apimodel.StructDef{Fields: apitest.Fields("Index", int32Type, "Info", info)}}
+	iwidget := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IWidget",
+		Attributes:   []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x22222222)},
+		InterfaceDef: &apimodel.InterfaceDef{}}
+	widget := &apimodel.Type{Kind: apimodel.TypeClass, Class: true, Name: "Widget"}
+	iwidgetFactory := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true,
+		Name:         "IWidgetFactory",
+		Attributes:   []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x33333333)},
+		InterfaceDef: &apimodel.InterfaceDef{}}
+	iwidgetStatics := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true,
+		Name:         "IWidgetStatics",
+		Attributes:   []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x44444444)},
+		InterfaceDef: &apimodel.InterfaceDef{}}
+	// composable class, constructed with the outer and inner objects of an aggregation
+	objectType := &apimodel.Type{Kind: apimodel.TypeAny, Any: true,
+		Name: "interface{}", FullName: "interface{}"}
+	ipanel := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IPanel",
+		Attributes:   []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x55555555)},
+		InterfaceDef: &apimodel.InterfaceDef{}}
+	panel := &apimodel.Type{Kind: apimodel.TypeClass, Class: true, Name: "Panel"}
+	ipanelFactory := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true,
+		Name:       "IPanelFactory",
+		Attributes: []*apimodel.Attribute{newApiGuidAttr(rtGuidAttr, 0x66666666)},
+		InterfaceDef: &apimodel.InterfaceDef{Methods: []*apimodel.Method{
+			{Name: "CreateInstance", Params: []*apimodel.Param{
+				apitest.Param("baseInterface", objectType),
+				apitest.OutParam("innerInterface", apitest.Ptr(objectType))}, ReturnType: panel},
+		}}}
+	testNs := apitest.Ns("Windows.UI.Widgets", kind, layout, info, entry, iwidget, iwidgetFactory,
+		iwidgetStatics, widget, ipanel, ipanelFactory, panel)
+
+	stringVector := apitest.GenericInst(ivector, stringType)
+	changedHandler := apitest.GenericInst(handler, widget, stringType)
+	propertyMap := apitest.GenericInst(imap, stringType,
+		apitest.GenericInst(ivector, apitest.GenericInst(ikeyValuePair, stringType, iclosable)))
+	iwidget.InterfaceDef.Methods = []*apimodel.Method{
+		{Name: "get_Name", ReturnType: stringType},
+		{Name: "put_Name", Params: []*apimodel.Param{apitest.Param("value", stringType)},
+			ReturnType: apitest.Void},
+		{Name: "get_Layout", ReturnType: layout},
+		{Name: "get_Entry", ReturnType: entry},
+		{Name: "put_MaxItems", Params: []*apimodel.Param{
+			apitest.Param("value", apitest.GenericInst(ireference, uint32Type))}, ReturnType: apitest.Void},
+		{Name: "get_Items", ReturnType: stringVector},
+		{Name: "get_Properties", ReturnType: propertyMap},
+		{Name: "add_Changed", Params: []*apimodel.Param{apitest.Param("handler", changedHandler)},
+			ReturnType: token},
+		{Name: "remove_Changed", Params: []*apimodel.Param{apitest.Param("token", token)},
+			ReturnType: apitest.Void},
+		{Name: "SetWeights", Params: []*apimodel.Param{
+			apitest.Param("weights", apitest.Array(int32Type))}, ReturnType: apitest.Void},
+		{Name: "GetWeights", Params: []*apimodel.Param{
+			apitest.OutParam("weights", apitest.Ptr(apitest.Array(int32Type)))}, ReturnType: apitest.Void},
+		{Name: "SetTags", Params: []*apimodel.Param{
+			apitest.Param("tags", apitest.Array(stringType))}, ReturnType: apitest.Void},
+		{Name: "get_Tags", ReturnType: apitest.Array(stringType)},
+		{Name: "FindItem", Params: []*apimodel.Param{
+			apitest.Param("maxIndex", apitest.GenericInst(ireference, uint32Type))}, ReturnType: stringType},
+	}
+	iwidgetFactory.InterfaceDef.Methods = []*apimodel.Method{
+		{Name: "CreateInstance", Params: []*apimodel.Param{apitest.Param("name", stringType)},
+			ReturnType: widget},
+		{Name: "CreateWithMaxItems", Params: []*apimodel.Param{apitest.Param("name", stringType),
+			apitest.Param("maxItems", apitest.GenericInst(ireference, uint32Type))}, ReturnType: widget},
+	}
+	iwidgetStatics.InterfaceDef.Methods = []*apimodel.Method{
+		{Name: "get_Default", ReturnType: widget},
+	}
+	widget.Attributes = []*apimodel.Attribute{
+		apitest.Attr("Windows.Foundation.Metadata.DualApiPartitionAttribute"),
+		apitest.Attr("Windows.Foundation.Metadata.ActivatableAttribute", uint32(0x10000)),
+		apitest.Attr("Windows.Foundation.Metadata.ActivatableAttribute",
+			"Windows.UI.Widgets.IWidgetFactory", uint32(0x10000), "Windows.Foundation.UniversalApiContract"),
+	}
+	widget.ClassDef = &apimodel.ClassDef{
+		Implements:       []*apimodel.Type{iwidget, iclosable, stringVector},
+		DefaultInterface: iwidget,
+		StaticInterfaces: []*apimodel.Type{iwidgetStatics},
+	}
+	ipanel.InterfaceDef.Methods = []*apimodel.Method{
+		{Name: "get_Child", ReturnType: widget},
+	}
+	panel.Attributes = []*apimodel.Attribute{
+		apitest.Attr("Windows.Foundation.Metadata.DualApiPartitionAttribute"),
+		apitest.Attr("Windows.Foundation.Metadata.ComposableAttribute",
+			"Windows.UI.Widgets.IPanelFactory", int32(2), uint32(0x10000),
+			"Windows.Foundation.UniversalApiContract"),
+	}
+	panel.ClassDef = &apimodel.ClassDef{
+		Implements:       []*apimodel.Type{ipanel},
+		DefaultInterface: ipanel,
+	}
+	return apitest.Model(foundationNs, collectionsNs, testNs)
+}
@@ -0,0 +1,206 @@
+package codegen
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/zzl/go-winapi-gen/utils"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// FileDrift is a file differing from the generated one,
+// Old is nil for missing files and New is nil for stale ones
+type FileDrift struct {
+	Path string
+	Old  []byte
+	New  []byte
+}
+
+// ManifestFileName is the file in OutputDir listing the generated files with their hashes
+const ManifestFileName = "winapi-gen.manifest.json"
+
+type manifest struct {
+	Provenance *Provenance       `json:"provenance,omitempty"`
+	Files      map[string]string `json:"files"` //slash separated relative path -> sha256
+}
+
+func loadManifest(filePath string) (*manifest, error) {
+	m := &manifest{Files: make(map[string]string)}
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]string)
+	}
+	return m, nil
+}
+
+// scanManifest stands in for a missing manifest, it lists the files in dir starting with
+// the generated code header. With migrate it also lists the .go files an output dir
+// cleaned by utils.CleanDir would lose, to remove the output of versions without headers.
+// Hand-written files are still kept by updateManifest
+func scanManifest(dir string, migrate bool) (*manifest, error) {
+	header := []byte(generatedCodeLine)
+	m := &manifest{Files: make(map[string]string)}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if path != dir && name[0] == '.' {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		listed := migrate && filepath.Ext(name) == ".go" && (name[0] < '0' || name[0] > '9')
+		if !listed {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			listed = bytes.HasPrefix(data, header)
+		}
+		if !listed {
+			return nil
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		m.Files[filepath.ToSlash(relPath)] = ""
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return m, nil
+}
+
+func hashContent(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFile writes a generated file under OutputDir unless its content is unchanged,
+// and records it in the manifest
+func (this *Generator) writeFile(relPath string, data []byte) error {
+	relPath = filepath.ToSlash(relPath)
+	hash := hashContent(data)
+	this.genFileMap[relPath] = hash
+
+	filePath := filepath.Join(this.OutputDir, relPath)
+	existing, err := ioutil.ReadFile(filePath)
+	if err == nil {
+		if hashContent(existing) == hash {
+			this.unchangedFileCount++
+			return nil
+		}
+		if utils.IsHandWritten(existing) {
+			return fmt.Errorf("%s: generated file would overwrite a hand-written file", relPath)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if this.CheckOnly {
+		this.Drifts = append(this.Drifts, &FileDrift{relPath, existing, data})
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	this.writtenFileCount++
+	return ioutil.WriteFile(filePath, data, 0666)
+}
+
+// updateManifest removes the files generated by the previous run but not by this one,
+// then saves the manifest of this run
+func (this *Generator) updateManifest(prev *manifest) error {
+	var stalePaths []string
+	for relPath := range prev.Files {
+		if _, ok := this.genFileMap[relPath]; !ok {
+			stalePaths = append(stalePaths, relPath)
+		}
+	}
+	sort.Strings(stalePaths)
+	for _, relPath := range stalePaths {
+		filePath := filepath.Join(this.OutputDir, relPath)
+		data, err := ioutil.ReadFile(filePath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if utils.IsHandWritten(data) {
+			continue
+		}
+		if this.CheckOnly {
+			this.Drifts = append(this.Drifts, &FileDrift{relPath, data, nil})
+			continue
+		}
+		err = os.Remove(filePath)
+		if err != nil {
+			return err
+		}
+		this.removedFileCount++
+		os.Remove(filepath.Dir(filePath)) //only succeeds when empty
+	}
+
+	sort.Slice(this.Drifts, func(i, j int) bool {
+		return this.Drifts[i].Path < this.Drifts[j].Path
+	})
+	if this.CheckOnly {
+		return nil
+	}
+
+	m := &manifest{Provenance: this.Provenance, Files: this.genFileMap}
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	filePath := filepath.Join(this.OutputDir, ManifestFileName)
+	existing, err := ioutil.ReadFile(filePath)
+	if err == nil && hashContent(existing) == hashContent(data) {
+		return nil
+	}
+	return ioutil.WriteFile(filePath, data, 0666)
+}
+
+// WriteDriftReport prints the unified diffs from OutputDir to the generated files
+func (this *Generator) WriteDriftReport(w io.Writer) error {
+	for _, drift := range this.Drifts {
+		oldName, newName := "a/"+drift.Path, "b/"+drift.Path
+		if drift.Old == nil {
+			oldName = "/dev/null"
+		} else if drift.New == nil {
+			newName = "/dev/null"
+		}
+		_, err := io.WriteString(w, unifiedDiff(oldName, newName,
+			string(drift.Old), string(drift.New)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileStats returns the numbers of files written, left unchanged and removed by Gen
+func (this *Generator) FileStats() (written int, unchanged int, removed int) {
+	return this.writtenFileCount, this.unchangedFileCount, this.removedFileCount
+}
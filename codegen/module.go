@@ -0,0 +1,74 @@
+package codegen
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+const DefaultGoVersion = "1.18"
+
+// import paths of the packages referenced but not generated
+var DefaultExtPkgPaths = map[string]string{
+	"win32":   "github.com/zzl/go-win32api/win32",
+	"com":     "github.com/zzl/go-com/com",
+	"windows": "golang.org/x/sys/windows",
+}
+
+// module versions of the requires, the winrt base declarations go-win32api v1.1.3
+// lacks are generated into the support files of the winrt packages
+var DefaultModuleVersions = map[string]string{
+	"github.com/zzl/go-win32api": "v1.1.3",
+	"github.com/zzl/go-com":      "v1.0.0",
+	"golang.org/x/sys":           "v0.0.0-20220330033206-e17cdc41300f",
+}
+
+func (this *Generator) genGoMod() {
+	goVersion := this.GoVersion
+	if goVersion == "" {
+		goVersion = DefaultGoVersion
+	}
+	requireSet := make(map[string]bool)
+	for imp := range this.usedImportSet {
+		modulePath := this.resolveModulePath(imp)
+		if modulePath != "" {
+			requireSet[modulePath] = true
+		}
+	}
+	var requires []string
+	for modulePath := range requireSet {
+		requires = append(requires, modulePath)
+	}
+	sort.Strings(requires)
+
+	var sb strings.Builder
+	sb.WriteString(this.genHeaderCode())
+	sb.WriteString("module " + this.ModulePath + "\n\n")
+	sb.WriteString("go " + goVersion + "\n")
+	if len(requires) > 0 {
+		sb.WriteString("\nrequire (\n")
+		for _, modulePath := range requires {
+			sb.WriteString("\t" + modulePath + " " + this.ModuleVersions[modulePath] + "\n")
+		}
+		sb.WriteString(")\n")
+	}
+	err := this.writeFile("go.mod", []byte(sb.String()))
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// module providing the import path, "" for std packages
+func (this *Generator) resolveModulePath(importPath string) string {
+	var modulePath string
+	for path := range this.ModuleVersions {
+		if (importPath == path || strings.HasPrefix(importPath, path+"/")) &&
+			len(path) > len(modulePath) {
+			modulePath = path
+		}
+	}
+	if modulePath == "" && strings.Contains(strings.SplitN(importPath, "/", 2)[0], ".") {
+		log.Panic("no module version for " + importPath)
+	}
+	return modulePath
+}
@@ -0,0 +1,144 @@
+package codegen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/zzl/go-winapi-gen/gomodel"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+const GeneratorName = "go-winapi-gen"
+
+// generatedCodeLine starts every generated file, in the standard form recognized by go tooling
+const generatedCodeLine = "// Code generated by " + GeneratorName + ". DO NOT EDIT.\n"
+
+// Provenance describes the inputs of a generation run,
+// summarized in the header of each generated file and recorded in full in the manifest
+type Provenance struct {
+	GeneratorVersion string             `json:"generatorVersion"`
+	MdFileName       string             `json:"mdFileName"`
+	MdFileHash       string             `json:"mdFileHash"` //sha256
+	MdVersion        string             `json:"mdVersion,omitempty"`
+	Filter           *gomodel.ApiFilter `json:"filter,omitempty"`
+}
+
+// NewProvenance hashes the winmd file, mdVersion is the metadata assembly version if known
+func NewProvenance(mdFilePath string, mdVersion string, filter *gomodel.ApiFilter) (*Provenance, error) {
+	file, err := os.Open(mdFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	return &Provenance{
+		GeneratorVersion: GeneratorVersion(),
+		MdFileName:       filepath.Base(mdFilePath),
+		MdFileHash:       hex.EncodeToString(hash.Sum(nil)),
+		MdVersion:        mdVersion,
+		Filter:           filter,
+	}, nil
+}
+
+// GeneratorVersion returns the module version of the running generator,
+// with the vcs revision for development builds
+func GeneratorVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	var revision string
+	var modified bool
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision != "" {
+		if len(revision) > 12 {
+			revision = revision[:12]
+		}
+		version += " " + revision
+		if modified {
+			version += "-dirty"
+		}
+	}
+	return version
+}
+
+// maxSummaryNamespaces limits the namespaces listed in the filter summary of file headers
+const maxSummaryNamespaces = 8
+
+// FilterHash identifies the filter config, which may be too long to list in full
+func (this *Provenance) FilterHash() string {
+	data, err := json.Marshal(this.Filter)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// FilterSummary describes the filter config in one line,
+// listing the first namespaces and counting the rest
+func (this *Provenance) FilterSummary() string {
+	f := this.Filter
+	var parts []string
+	if len(f.Namespaces) > 0 {
+		nss := f.Namespaces
+		if len(nss) > maxSummaryNamespaces {
+			nss = nss[:maxSummaryNamespaces]
+		}
+		summary := "namespaces " + strings.Join(nss, ",")
+		if more := len(f.Namespaces) - len(nss); more > 0 {
+			summary += " (+" + strconv.Itoa(more) + " more)"
+		}
+		parts = append(parts, summary)
+	}
+	if len(f.Architectures) > 0 {
+		parts = append(parts, "architectures "+strings.Join(f.Architectures, ","))
+	}
+	if len(f.DllImports) > 0 {
+		parts = append(parts, "dlls "+strings.Join(f.DllImports, ","))
+	}
+	if f.MaxOsVersion != "" {
+		parts = append(parts, "max os "+f.MaxOsVersion)
+	}
+	parts = append(parts, "sha256:"+this.FilterHash())
+	return strings.Join(parts, "; ")
+}
+
+// genHeaderCode generates the comment starting every generated file,
+// in the standard form recognized by go tooling
+func (this *Generator) genHeaderCode() string {
+	code := generatedCodeLine
+	p := this.Provenance
+	if p == nil {
+		return code + "\n"
+	}
+	code += "//\n"
+	code += "// generator: " + GeneratorName + " " + p.GeneratorVersion + "\n"
+	mdInfo := []string{p.MdFileName}
+	if p.MdVersion != "" {
+		mdInfo = append(mdInfo, p.MdVersion)
+	}
+	mdInfo = append(mdInfo, "sha256:"+p.MdFileHash)
+	code += "// winmd: " + strings.Join(mdInfo, " ") + "\n"
+	if p.Filter != nil {
+		code += "// filter: " + p.FilterSummary() + "\n"
+	}
+	return code + "\n"
+}
@@ -0,0 +1,141 @@
+package codegen
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// file split strategies
+const (
+	FileSplitNone    = ""     // one file per namespace
+	FileSplitByKind  = "kind" // one file per entity kind
+	FileSplitBySize  = "size" // new file whenever FileSplitSize is reached
+	FileSplitPerType = "type" // one file per interface and class
+)
+
+const DefaultFileSplitSize = 512 * 1024
+
+// chunk kinds, in the order they're generated
+const (
+	chunkTypeAliases   = "typeAliases"
+	chunkConsts        = "consts"
+	chunkPointerConsts = "pointerConsts"
+	chunkVars          = "vars"
+	chunkEnums         = "enums"
+	chunkStructs       = "structs"
+	chunkFuncTypes     = "funcTypes"
+	chunkInterfaces    = "interfaces"
+	chunkClasses       = "classes"
+	chunkSysCallVars   = "sysCallVars"
+	chunkSysCalls      = "sysCalls"
+)
+
+// consecutive chunks of these kinds are grouped in a block
+var chunkBlockMap = map[string]string{
+	chunkTypeAliases:   "type",
+	chunkConsts:        "const",
+	chunkPointerConsts: "var",
+	chunkVars:          "var",
+	chunkSysCallVars:   "var",
+}
+
+var chunkHeaderMap = map[string]string{
+	chunkEnums:      "// enums\n\n",
+	chunkStructs:    "// structs\n\n",
+	chunkFuncTypes:  "// func types\n\n",
+	chunkInterfaces: "// interfaces\n\n",
+	chunkClasses:    "// classes\n\n",
+}
+
+// file name suffixes for FileSplitByKind
+var chunkFileKindMap = map[string]string{
+	chunkTypeAliases:   "consts",
+	chunkConsts:        "consts",
+	chunkPointerConsts: "consts",
+	chunkVars:          "consts",
+	chunkEnums:         "enums",
+	chunkStructs:       "structs",
+	chunkFuncTypes:     "funcs",
+	chunkInterfaces:    "interfaces",
+	chunkClasses:       "classes",
+	chunkSysCallVars:   "funcs",
+	chunkSysCalls:      "funcs",
+}
+
+// a top level declaration, or a spec within a block
+type fileChunk struct {
+	kind   string
+	name   string
+	origin string //full name of the metadata entity
+	code   string
+}
+
+// assembleChunks builds the code of a file in the current package context
+func (this *Generator) assembleChunks(chunks []*fileChunk) string {
+	var sb strings.Builder
+	sb.WriteString("package " + this.basePkgName(this.contextPkgName) + "\n\n")
+	for n, chunk := range chunks {
+		var prevKind string
+		if n > 0 {
+			prevKind = chunks[n-1].kind
+		}
+		block := chunkBlockMap[chunk.kind]
+		if chunk.kind != prevKind {
+			sb.WriteString(chunkHeaderMap[chunk.kind])
+			if block != "" {
+				sb.WriteString(block + " (\n")
+			}
+		}
+		sb.WriteString(chunk.code)
+		if block != "" && (n == len(chunks)-1 || chunks[n+1].kind != chunk.kind) {
+			sb.WriteString(")\n\n")
+		}
+	}
+	return sb.String()
+}
+
+// splitChunks distributes the chunks of a package among files by FileSplit
+func (this *Generator) splitChunks(fileName string, chunks []*fileChunk) map[string][]*fileChunk {
+	baseName := strings.TrimSuffix(fileName, ".go")
+	fileChunksMap := make(map[string][]*fileChunk)
+	switch this.FileSplit {
+	case FileSplitNone:
+		fileChunksMap[fileName] = chunks
+	case FileSplitByKind:
+		for _, chunk := range chunks {
+			name := baseName + "_" + chunkFileKindMap[chunk.kind] + ".go"
+			fileChunksMap[name] = append(fileChunksMap[name], chunk)
+		}
+	case FileSplitBySize:
+		splitSize := this.FileSplitSize
+		if splitSize <= 0 {
+			splitSize = DefaultFileSplitSize
+		}
+		fileIndex, size := 1, 0
+		name := fileName
+		for _, chunk := range chunks {
+			if size > 0 && size+len(chunk.code) > splitSize {
+				fileIndex++
+				name = baseName + "_" + strconv.Itoa(fileIndex) + ".go"
+				size = 0
+			}
+			size += len(chunk.code)
+			fileChunksMap[name] = append(fileChunksMap[name], chunk)
+		}
+	case FileSplitPerType:
+		for _, chunk := range chunks {
+			name := fileName
+			if chunk.kind == chunkInterfaces || chunk.kind == chunkClasses {
+				name = baseName + "_" + chunk.name + ".go"
+			}
+			fileChunksMap[name] = append(fileChunksMap[name], chunk)
+		}
+	default:
+		log.Panic("unknown file split strategy " + this.FileSplit)
+	}
+	if len(fileChunksMap) == 0 {
+		fileChunksMap[fileName] = nil
+	}
+	return fileChunksMap
+}
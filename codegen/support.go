@@ -0,0 +1,1075 @@
+package codegen
+
+import (
+	"bytes"
+	"github.com/zzl/go-winapi-gen/gomodel"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const SupportFileName = "support.go"
+
+const lazyAddrCode = `func lazyAddr(pAddr *uintptr, lib *windows.LazyDLL, procName string) uintptr {
+	addr := atomic.LoadUintptr(pAddr)
+	if addr == 0 {
+		addr = lib.NewProc(procName).Addr()
+		atomic.StoreUintptr(pAddr, addr)
+	}
+	return addr
+}
+
+`
+
+const comCode = `// ComInterface constrains the pointers to the generated COM interfaces
+type ComInterface[T any] interface {
+	*T
+	IID() *syscall.GUID
+}
+
+// As queries obj for the COM interface T by its IID, the caller releases the result
+func As[T any, PT ComInterface[T]](obj *win32.IUnknown) (PT, error) {
+	var p PT
+	hr := obj.QueryInterface(PT(nil).IID(), unsafe.Pointer(&p))
+	if win32.FAILED(hr) {
+		return nil, syscall.Errno(uint32(hr))
+	}
+	return p, nil
+}
+
+`
+
+// rtBaseCode declares the winrt base types and functions the go-win32api module lacks
+const rtBaseCode = `type HSTRING = uintptr
+
+type IInspectableInterface interface {
+	win32.IUnknownInterface
+	GetIids(iidCount *uint32, iids **syscall.GUID) win32.HRESULT
+	GetRuntimeClassName(className *HSTRING) win32.HRESULT
+	GetTrustLevel(trustLevel *int32) win32.HRESULT
+}
+
+type IInspectableVtbl struct {
+	win32.IUnknownVtbl
+	GetIids             uintptr
+	GetRuntimeClassName uintptr
+	GetTrustLevel       uintptr
+}
+
+type IInspectable struct {
+	win32.IUnknown
+}
+
+func (this *IInspectable) Vtbl() *IInspectableVtbl {
+	return (*IInspectableVtbl)(unsafe.Pointer(this.IUnknown.LpVtbl))
+}
+
+func (this *IInspectable) GetIids(iidCount *uint32, iids **syscall.GUID) win32.HRESULT {
+	ret, _, _ := syscall.SyscallN(this.Vtbl().GetIids, uintptr(unsafe.Pointer(this)),
+		uintptr(unsafe.Pointer(iidCount)), uintptr(unsafe.Pointer(iids)))
+	return win32.HRESULT(ret)
+}
+
+func (this *IInspectable) GetRuntimeClassName(className *HSTRING) win32.HRESULT {
+	ret, _, _ := syscall.SyscallN(this.Vtbl().GetRuntimeClassName, uintptr(unsafe.Pointer(this)),
+		uintptr(unsafe.Pointer(className)))
+	return win32.HRESULT(ret)
+}
+
+func (this *IInspectable) GetTrustLevel(trustLevel *int32) win32.HRESULT {
+	ret, _, _ := syscall.SyscallN(this.Vtbl().GetTrustLevel, uintptr(unsafe.Pointer(this)),
+		uintptr(unsafe.Pointer(trustLevel)))
+	return win32.HRESULT(ret)
+}
+
+// 00000035-0000-0000-C000-000000000046
+var IID_IActivationFactory = syscall.GUID{0x00000035, 0x0000, 0x0000,
+	[8]byte{0xC0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x46}}
+
+type IActivationFactoryVtbl struct {
+	IInspectableVtbl
+	ActivateInstance uintptr
+}
+
+type IActivationFactory struct {
+	IInspectable
+}
+
+func (this *IActivationFactory) Vtbl() *IActivationFactoryVtbl {
+	return (*IActivationFactoryVtbl)(unsafe.Pointer(this.IUnknown.LpVtbl))
+}
+
+func (this *IActivationFactory) ActivateInstance(instance **IInspectable) win32.HRESULT {
+	ret, _, _ := syscall.SyscallN(this.Vtbl().ActivateInstance, uintptr(unsafe.Pointer(this)),
+		uintptr(unsafe.Pointer(instance)))
+	return win32.HRESULT(ret)
+}
+
+var (
+	libCombase = windows.NewLazySystemDLL("combase.dll")
+
+	procRoGetActivationFactory    = libCombase.NewProc("RoGetActivationFactory")
+	procWindowsCreateString       = libCombase.NewProc("WindowsCreateString")
+	procWindowsDeleteString       = libCombase.NewProc("WindowsDeleteString")
+	procWindowsDuplicateString    = libCombase.NewProc("WindowsDuplicateString")
+	procWindowsGetStringRawBuffer = libCombase.NewProc("WindowsGetStringRawBuffer")
+)
+
+func RoGetActivationFactory(activatableClassId HSTRING, iid *syscall.GUID, factory unsafe.Pointer) win32.HRESULT {
+	ret, _, _ := procRoGetActivationFactory.Call(activatableClassId, uintptr(unsafe.Pointer(iid)), uintptr(factory))
+	return win32.HRESULT(ret)
+}
+
+func WindowsCreateString(sourceString *uint16, length uint32, hs *HSTRING) win32.HRESULT {
+	ret, _, _ := procWindowsCreateString.Call(uintptr(unsafe.Pointer(sourceString)), uintptr(length),
+		uintptr(unsafe.Pointer(hs)))
+	return win32.HRESULT(ret)
+}
+
+func WindowsDeleteString(hs HSTRING) win32.HRESULT {
+	ret, _, _ := procWindowsDeleteString.Call(hs)
+	return win32.HRESULT(ret)
+}
+
+func WindowsDuplicateString(hs HSTRING, newString *HSTRING) win32.HRESULT {
+	ret, _, _ := procWindowsDuplicateString.Call(hs, uintptr(unsafe.Pointer(newString)))
+	return win32.HRESULT(ret)
+}
+
+func WindowsGetStringRawBuffer(hs HSTRING, length *uint32) *uint16 {
+	ret, _, _ := procWindowsGetStringRawBuffer.Call(hs, uintptr(unsafe.Pointer(length)))
+	return *(**uint16)(unsafe.Pointer(&ret))
+}
+
+`
+
+const hstrCode = `type HStr struct {
+	Ptr HSTRING
+}
+
+func NewHStr(str string) *HStr {
+	hs := &HStr{}
+	if str == "" {
+		return hs
+	}
+	wsz, _ := syscall.UTF16FromString(str)
+	hr := WindowsCreateString(&wsz[0], uint32(len(wsz)-1), &hs.Ptr)
+	if win32.FAILED(hr) {
+		log.Panic(syscall.Errno(uint32(hr)))
+	}
+	com.AddToScope(hs)
+	return hs
+}
+
+func (this *HStr) Release() uint32 {
+	if this.Ptr != 0 {
+		WindowsDeleteString(this.Ptr)
+		this.Ptr = 0
+	}
+	return 0
+}
+
+func HStringToStr(hs HSTRING) string {
+	if hs == 0 {
+		return ""
+	}
+	var length uint32
+	pwsz := WindowsGetStringRawBuffer(hs, &length)
+	if length == 0 {
+		return ""
+	}
+	wsz := unsafe.Slice(pwsz, length)
+	return string(utf16.Decode(wsz))
+}
+
+func HStringToStrAndFree(hs HSTRING) string {
+	str := HStringToStr(hs)
+	if hs != 0 {
+		WindowsDeleteString(hs)
+	}
+	return str
+}
+
+type RtClass struct {
+	PInspect *IInspectable
+}
+
+`
+
+const arrayCode = `// arrayArg passes items as a caller allocated array,
+// strings go as hstrings created in the current scope
+func arrayArg[T any](items []T) unsafe.Pointer {
+	if len(items) == 0 {
+		return nil
+	}
+	switch strs := any(items).(type) {
+	case []string:
+		hss := make([]HSTRING, len(strs))
+		for n, str := range strs {
+			hss[n] = NewHStr(str).Ptr
+		}
+		return unsafe.Pointer(&hss[0])
+	case []String:
+		hss := make([]HSTRING, len(strs))
+		for n, str := range strs {
+			hss[n] = NewHStr(string(str)).Ptr
+		}
+		return unsafe.Pointer(&hss[0])
+	}
+	return unsafe.Pointer(&items[0])
+}
+
+// fillArrayArg returns the buffer the callee fills for items, hstrings for strings,
+// it is passed to fromAbiArray after the call
+func fillArrayArg[T any](items []T) unsafe.Pointer {
+	if len(items) == 0 {
+		return nil
+	}
+	switch any(items).(type) {
+	case []string, []String:
+		hss := make([]HSTRING, len(items))
+		return unsafe.Pointer(&hss[0])
+	}
+	return unsafe.Pointer(&items[0])
+}
+
+// fromAbiArray sets items from the callee filled buffer p, the hstrings are converted and freed,
+// the interfaces kept in the current scope and the structs owning references must be released
+func fromAbiArray[T any](items []T, p unsafe.Pointer) {
+	if len(items) == 0 || p == nil {
+		return
+	}
+	switch strs := any(items).(type) {
+	case []string:
+		for n, hs := range unsafe.Slice((*HSTRING)(p), len(strs)) {
+			strs[n] = HStringToStrAndFree(hs)
+		}
+	case []String:
+		for n, hs := range unsafe.Slice((*HSTRING)(p), len(strs)) {
+			strs[n] = String(HStringToStrAndFree(hs))
+		}
+	default:
+		if p != unsafe.Pointer(&items[0]) {
+			copy(items, unsafe.Slice((*T)(p), len(items)))
+		}
+		for n := range items {
+			if item, ok := any(items[n]).(interface{ FromAbi() T }); ok {
+				items[n] = item.FromAbi()
+			}
+		}
+	}
+}
+
+// receiveArray copies the callee allocated array p to a slice and frees it with CoTaskMemFree
+func receiveArray[T any](length uint32, p unsafe.Pointer) []T {
+	if p == nil {
+		return nil
+	}
+	defer win32.CoTaskMemFree(p)
+	items := make([]T, length)
+	fromAbiArray(items, p)
+	return items
+}
+
+`
+
+const genericCode = `// RtType constrains the type args of WinRT generics to the types with an abi representation,
+// generated structs, enums and interface pointers, and the wrappers of the fundamental types
+type RtType[T any] interface {
+	// AbiArg converts the value to a syscall argument
+	AbiArg() uintptr
+	// FromAbi converts the value written by abi code to its Go value,
+	// structs owning references keep them and must be released
+	FromAbi() T
+	// RtSignature returns the winrt type signature, for parameterized iids
+	RtSignature() string
+}
+
+func rtSignatureOf[T RtType[T]]() string {
+	var t T
+	return t.RtSignature()
+}
+
+var parameterizedIIDs sync.Map
+
+// ParameterizedIID computes the iid of a generic instance from its winrt type signature,
+// class type args are signed as their default interfaces, the generated IID_ vars of
+// the instances used by the api sign them as classes
+func ParameterizedIID(sig string) *syscall.GUID {
+	if iid, ok := parameterizedIIDs.Load(sig); ok {
+		return iid.(*syscall.GUID)
+	}
+	//sha1 of the pinterface namespace guid 11f47ad5-7b73-42c0-abae-878b1e16adee and sig
+	h := sha1.New()
+	h.Write([]byte{0x11, 0xf4, 0x7a, 0xd5, 0x7b, 0x73, 0x42, 0xc0,
+		0xab, 0xae, 0x87, 0x8b, 0x1e, 0x16, 0xad, 0xee})
+	h.Write([]byte(sig))
+	sum := h.Sum(nil)
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	iid := &syscall.GUID{
+		Data1: binary.BigEndian.Uint32(sum[0:4]),
+		Data2: binary.BigEndian.Uint16(sum[4:6]),
+		Data3: binary.BigEndian.Uint16(sum[6:8]),
+	}
+	copy(iid.Data4[:], sum[8:16])
+	actual, _ := parameterizedIIDs.LoadOrStore(sig, iid)
+	return actual.(*syscall.GUID)
+}
+
+func structAbiArg(p unsafe.Pointer, size uintptr) uintptr {
+	if size > unsafe.Sizeof(uintptr(0)) {
+		return uintptr(p)
+	}
+	var arg uintptr
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&arg)), size), unsafe.Slice((*byte)(p), size))
+	return arg
+}
+
+type Boolean bool
+
+func (this Boolean) AbiArg() uintptr {
+	if this {
+		return 1
+	}
+	return 0
+}
+
+func (this Boolean) FromAbi() Boolean {
+	return this
+}
+
+func (this Boolean) RtSignature() string {
+	return "b1"
+}
+
+type Int8 int8
+
+func (this Int8) AbiArg() uintptr {
+	return uintptr(this)
+}
+
+func (this Int8) FromAbi() Int8 {
+	return this
+}
+
+func (this Int8) RtSignature() string {
+	return "i1"
+}
+
+type UInt8 uint8
+
+func (this UInt8) AbiArg() uintptr {
+	return uintptr(this)
+}
+
+func (this UInt8) FromAbi() UInt8 {
+	return this
+}
+
+func (this UInt8) RtSignature() string {
+	return "u1"
+}
+
+type Int16 int16
+
+func (this Int16) AbiArg() uintptr {
+	return uintptr(this)
+}
+
+func (this Int16) FromAbi() Int16 {
+	return this
+}
+
+func (this Int16) RtSignature() string {
+	return "i2"
+}
+
+type UInt16 uint16
+
+func (this UInt16) AbiArg() uintptr {
+	return uintptr(this)
+}
+
+func (this UInt16) FromAbi() UInt16 {
+	return this
+}
+
+func (this UInt16) RtSignature() string {
+	return "u2"
+}
+
+type Int32 int32
+
+func (this Int32) AbiArg() uintptr {
+	return uintptr(this)
+}
+
+func (this Int32) FromAbi() Int32 {
+	return this
+}
+
+func (this Int32) RtSignature() string {
+	return "i4"
+}
+
+type UInt32 uint32
+
+func (this UInt32) AbiArg() uintptr {
+	return uintptr(this)
+}
+
+func (this UInt32) FromAbi() UInt32 {
+	return this
+}
+
+func (this UInt32) RtSignature() string {
+	return "u4"
+}
+
+type Int64 int64
+
+func (this Int64) AbiArg() uintptr {
+	return uintptr(this)
+}
+
+func (this Int64) FromAbi() Int64 {
+	return this
+}
+
+func (this Int64) RtSignature() string {
+	return "i8"
+}
+
+type UInt64 uint64
+
+func (this UInt64) AbiArg() uintptr {
+	return uintptr(this)
+}
+
+func (this UInt64) FromAbi() UInt64 {
+	return this
+}
+
+func (this UInt64) RtSignature() string {
+	return "u8"
+}
+
+type Single float32
+
+func (this Single) AbiArg() uintptr {
+	return uintptr(math.Float32bits(float32(this)))
+}
+
+func (this Single) FromAbi() Single {
+	return this
+}
+
+func (this Single) RtSignature() string {
+	return "f4"
+}
+
+type Double float64
+
+func (this Double) AbiArg() uintptr {
+	return uintptr(math.Float64bits(float64(this)))
+}
+
+func (this Double) FromAbi() Double {
+	return this
+}
+
+func (this Double) RtSignature() string {
+	return "f8"
+}
+
+type Guid syscall.GUID
+
+func (this Guid) AbiArg() uintptr {
+	return structAbiArg(unsafe.Pointer(&this), unsafe.Sizeof(this))
+}
+
+func (this Guid) FromAbi() Guid {
+	return this
+}
+
+func (this Guid) RtSignature() string {
+	return "g16"
+}
+
+// String is passed to abi code as an HSTRING
+type String string
+
+func (this String) AbiArg() uintptr {
+	return NewHStr(string(this)).Ptr
+}
+
+// FromAbi converts the HSTRING abi code wrote over the string header
+func (this String) FromAbi() String {
+	hs := *(*HSTRING)(unsafe.Pointer(&this))
+	return String(HStringToStrAndFree(hs))
+}
+
+func (this String) RtSignature() string {
+	return "string"
+}
+
+// Object is an IInspectable of any runtime class
+type Object struct {
+	IInspectable
+}
+
+func (this *Object) AbiArg() uintptr {
+	return uintptr(unsafe.Pointer(this))
+}
+
+func (this *Object) FromAbi() *Object {
+	if this != nil {
+		com.AddToScope(this)
+	}
+	return this
+}
+
+func (this *Object) RtSignature() string {
+	return "cinterface(IInspectable)"
+}
+
+`
+
+const boxCode = `// the Windows.Foundation generic interfaces boxed values implement, IReference[T] and IReferenceArray[T]
+const (
+	iReferenceSig      = "pinterface({61c17706-2d65-11e0-9ae8-d48564015472};"
+	iReferenceArraySig = "pinterface({61c1770a-2d65-11e0-9ae8-d48564015472};"
+)
+
+// 629BDBC8-D932-4FF4-96B9-8D96C5C1E858
+var iidIPropertyValueStatics = syscall.GUID{0x629BDBC8, 0xD932, 0x4FF4,
+	[8]byte{0x96, 0xB9, 0x8D, 0x96, 0xC5, 0xC1, 0xE8, 0x58}}
+
+// the IPropertyValueStatics.CreateX methods by the signatures of the boxed types,
+// the CreateXArray methods follow at propertyValueArrayOffset
+var propertyValueCreators = map[string]int{
+	"u1": 1, "i2": 2, "u2": 3, "i4": 4, "u4": 5, "i8": 6, "u8": 7, "f4": 8, "f8": 9,
+	"b1": 11, "string": 12, "g16": 14,
+	"struct(Windows.Foundation.DateTime;i8)":      15,
+	"struct(Windows.Foundation.TimeSpan;i8)":      16,
+	"struct(Windows.Foundation.Point;f4;f4)":      17,
+	"struct(Windows.Foundation.Size;f4;f4)":       18,
+	"struct(Windows.Foundation.Rect;f4;f4;f4;f4)": 19,
+}
+
+const propertyValueArrayOffset = 19
+
+var pPropertyValueStatics unsafe.Pointer
+
+func getPropertyValueStatics() (*IInspectable, error) {
+	p := (*IInspectable)(atomic.LoadPointer(&pPropertyValueStatics))
+	if p != nil {
+		return p, nil
+	}
+	hs := NewHStr("Windows.Foundation.PropertyValue")
+	hr := RoGetActivationFactory(hs.Ptr, &iidIPropertyValueStatics, unsafe.Pointer(&p))
+	if win32.FAILED(hr) {
+		return nil, syscall.Errno(uint32(hr))
+	}
+	if !atomic.CompareAndSwapPointer(&pPropertyValueStatics, nil, unsafe.Pointer(p)) {
+		p.Release()
+		p = (*IInspectable)(atomic.LoadPointer(&pPropertyValueStatics))
+	}
+	return p, nil
+}
+
+// calls the nth IPropertyValueStatics method
+func createPropertyValue(n int, args ...uintptr) (*Object, error) {
+	statics, err := getPropertyValueStatics()
+	if err != nil {
+		return nil, err
+	}
+	var p *Object
+	args = append([]uintptr{uintptr(unsafe.Pointer(statics))}, args...)
+	args = append(args, uintptr(unsafe.Pointer(&p)))
+	hr, _, _ := syscall.SyscallN(statics.LpVtbl[6+n], args...)
+	if win32.FAILED(win32.HRESULT(hr)) {
+		return nil, syscall.Errno(uint32(hr))
+	}
+	com.AddToScope(p)
+	return p, nil
+}
+
+// Box boxes a value with Windows.Foundation.PropertyValue,
+// the result implements IPropertyValue and IReference[T]
+func Box[T RtType[T]](value T) (*Object, error) {
+	n, ok := propertyValueCreators[value.RtSignature()]
+	if !ok {
+		return nil, errors.New("not boxable: " + value.RtSignature())
+	}
+	return createPropertyValue(n, value.AbiArg())
+}
+
+// BoxArray boxes values with Windows.Foundation.PropertyValue,
+// the result implements IPropertyValue and IReferenceArray[T]
+func BoxArray[T RtType[T]](values []T) (*Object, error) {
+	var t T
+	n, ok := propertyValueCreators[t.RtSignature()]
+	if !ok {
+		return nil, errors.New("not boxable: " + t.RtSignature())
+	}
+	var p unsafe.Pointer
+	if strs, ok := any(values).([]String); ok {
+		hss := make([]HSTRING, len(strs))
+		for n, str := range strs {
+			hss[n] = NewHStr(string(str)).Ptr
+		}
+		if len(hss) > 0 {
+			p = unsafe.Pointer(&hss[0])
+		}
+	} else if len(values) > 0 {
+		p = unsafe.Pointer(&values[0])
+	}
+	return createPropertyValue(n+propertyValueArrayOffset, uintptr(len(values)), uintptr(p))
+}
+
+func BoxDateTime(t time.Time) (*Object, error) {
+	return createPropertyValue(15, uintptr(toUniversalTime(t)))
+}
+
+func BoxTimeSpan(d time.Duration) (*Object, error) {
+	return createPropertyValue(16, uintptr(d/100))
+}
+
+// boxReferenceArg boxes an optional value as an IReference[T] argument, 0 for nil
+func boxReferenceArg[T RtType[T]](value *T) (uintptr, error) {
+	if value == nil {
+		return 0, nil
+	}
+	obj, err := Box(*value)
+	if err != nil {
+		return 0, err
+	}
+	var ref *win32.IUnknown
+	hr := obj.QueryInterface(ParameterizedIID(iReferenceSig+(*value).RtSignature()+")"), unsafe.Pointer(&ref))
+	if win32.FAILED(hr) {
+		return 0, syscall.Errno(uint32(hr))
+	}
+	com.AddToScope(ref)
+	return uintptr(unsafe.Pointer(ref)), nil
+}
+
+// unboxReference reads the value of obj as an IReference of the type signed sig into p
+func unboxReference(obj *Object, sig string, p unsafe.Pointer) bool {
+	if obj == nil {
+		return false
+	}
+	var ref *win32.IUnknown
+	hr := obj.QueryInterface(ParameterizedIID(iReferenceSig+sig+")"), unsafe.Pointer(&ref))
+	if win32.FAILED(hr) {
+		return false
+	}
+	defer ref.Release()
+	hr2, _, _ := syscall.SyscallN(ref.LpVtbl[6], uintptr(unsafe.Pointer(ref)), uintptr(p))
+	return !win32.FAILED(win32.HRESULT(hr2))
+}
+
+// Unbox unboxes a value boxed as IReference[T], or casts obj to T if T is an interface
+func Unbox[T RtType[T]](obj *Object) (T, bool) {
+	var value T
+	if obj == nil {
+		return value, false
+	}
+	if p, ok := any(obj).(T); ok { //*Object
+		obj.AddRef()
+		com.AddToScope(obj)
+		return p, true
+	}
+	if intf, ok := any(value).(interface{ IID() *syscall.GUID }); ok {
+		hr := obj.QueryInterface(intf.IID(), unsafe.Pointer(&value))
+		if win32.FAILED(hr) {
+			return value, false
+		}
+		return value.FromAbi(), true
+	}
+	if !unboxReference(obj, value.RtSignature(), unsafe.Pointer(&value)) {
+		return value, false
+	}
+	return value.FromAbi(), true
+}
+
+// UnboxArray unboxes values boxed as IReferenceArray[T]
+func UnboxArray[T RtType[T]](obj *Object) ([]T, bool) {
+	var t T
+	if obj == nil {
+		return nil, false
+	}
+	var ref *win32.IUnknown
+	hr := obj.QueryInterface(ParameterizedIID(iReferenceArraySig+t.RtSignature()+")"), unsafe.Pointer(&ref))
+	if win32.FAILED(hr) {
+		return nil, false
+	}
+	defer ref.Release()
+	var length uint32
+	var p unsafe.Pointer
+	hr2, _, _ := syscall.SyscallN(ref.LpVtbl[6], uintptr(unsafe.Pointer(ref)),
+		uintptr(unsafe.Pointer(&length)), uintptr(unsafe.Pointer(&p)))
+	if win32.FAILED(win32.HRESULT(hr2)) {
+		return nil, false
+	}
+	return receiveArray[T](length, p), true
+}
+
+func UnboxDateTime(obj *Object) (time.Time, bool) {
+	var universalTime int64
+	if !unboxReference(obj, "struct(Windows.Foundation.DateTime;i8)", unsafe.Pointer(&universalTime)) {
+		return time.Time{}, false
+	}
+	return fromUniversalTime(universalTime), true
+}
+
+func UnboxTimeSpan(obj *Object) (time.Duration, bool) {
+	var duration int64
+	if !unboxReference(obj, "struct(Windows.Foundation.TimeSpan;i8)", unsafe.Pointer(&duration)) {
+		return 0, false
+	}
+	return time.Duration(duration) * 100, true
+}
+
+// the 100ns intervals between 1601-01-01 and 1970-01-01
+const universalTimeUnixEpoch = 116444736000000000
+
+// toUniversalTime converts t to the 100ns intervals since 1601-01-01 of DateTime
+func toUniversalTime(t time.Time) int64 {
+	return t.Unix()*10000000 + int64(t.Nanosecond()/100) + universalTimeUnixEpoch
+}
+
+func fromUniversalTime(universalTime int64) time.Time {
+	universalTime -= universalTimeUnixEpoch
+	return time.Unix(universalTime/10000000, universalTime%10000000*100)
+}
+
+`
+
+const delegateCode = `type funcDelegateVtbl struct {
+	QueryInterface uintptr
+	AddRef         uintptr
+	Release        uintptr
+	Invoke         uintptr
+}
+
+type funcDelegate struct {
+	LpVtbl   *funcDelegateVtbl
+	refCount int32
+	fn       reflect.Value
+	iid      *syscall.GUID
+}
+
+var (
+	funcDelegateMap = make(map[*funcDelegate]bool)
+	funcDelegateMu  sync.Mutex
+
+	funcDelegateVtbls [4]*funcDelegateVtbl
+	funcDelegateOnce  sync.Once
+)
+
+func initFuncDelegateVtbls() {
+	queryInterface := syscall.NewCallback(func(this *funcDelegate, riid *syscall.GUID, ppv *unsafe.Pointer) uintptr {
+		if *riid == win32.IID_IUnknown || *riid == win32.IID_IAgileObject ||
+			this.iid != nil && *riid == *this.iid {
+			*ppv = unsafe.Pointer(this)
+			atomic.AddInt32(&this.refCount, 1)
+			return 0
+		}
+		*ppv = nil
+		return uintptr(0x80004002) //E_NOINTERFACE
+	})
+	addRef := syscall.NewCallback(func(this *funcDelegate) uintptr {
+		return uintptr(atomic.AddInt32(&this.refCount, 1))
+	})
+	release := syscall.NewCallback(func(this *funcDelegate) uintptr {
+		refCount := atomic.AddInt32(&this.refCount, -1)
+		if refCount == 0 {
+			funcDelegateMu.Lock()
+			delete(funcDelegateMap, this)
+			funcDelegateMu.Unlock()
+		}
+		return uintptr(refCount)
+	})
+	invokes := []uintptr{
+		syscall.NewCallback(func(this *funcDelegate) uintptr {
+			return this.invoke()
+		}),
+		syscall.NewCallback(func(this *funcDelegate, a1 uintptr) uintptr {
+			return this.invoke(a1)
+		}),
+		syscall.NewCallback(func(this *funcDelegate, a1, a2 uintptr) uintptr {
+			return this.invoke(a1, a2)
+		}),
+		syscall.NewCallback(func(this *funcDelegate, a1, a2, a3 uintptr) uintptr {
+			return this.invoke(a1, a2, a3)
+		}),
+	}
+	for n, invoke := range invokes {
+		funcDelegateVtbls[n] = &funcDelegateVtbl{
+			QueryInterface: queryInterface,
+			AddRef:         addRef,
+			Release:        release,
+			Invoke:         invoke,
+		}
+	}
+}
+
+func (this *funcDelegate) invoke(args ...uintptr) uintptr {
+	fnType := this.fn.Type()
+	var argValues []reflect.Value
+	for n, arg := range args {
+		argType := fnType.In(n)
+		var argValue reflect.Value
+		if argType.Kind() == reflect.String {
+			argValue = reflect.ValueOf(HStringToStr(HSTRING(arg))).Convert(argType)
+		} else if argType.Size() > unsafe.Sizeof(arg) {
+			argValue = reflect.NewAt(argType, *(*unsafe.Pointer)(unsafe.Pointer(&arg))).Elem()
+		} else {
+			argValue = reflect.NewAt(argType, unsafe.Pointer(&arg)).Elem()
+		}
+		argValues = append(argValues, argValue)
+	}
+	results := this.fn.Call(argValues)
+	if len(results) == 0 {
+		return 0
+	}
+	result := results[0]
+	switch result.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uintptr(uint32(result.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return uintptr(uint32(result.Uint()))
+	case reflect.Interface:
+		if result.IsNil() {
+			return 0
+		}
+		return uintptr(0x80004005) //E_FAIL
+	}
+	return 0
+}
+
+func newFuncDelegate(fn any, argCount int) *win32.IUnknown {
+	funcDelegateOnce.Do(initFuncDelegateVtbls)
+	d := &funcDelegate{
+		LpVtbl:   funcDelegateVtbls[argCount],
+		refCount: 1,
+		fn:       reflect.ValueOf(fn),
+	}
+	if intf, ok := fn.(interface{ IID() *syscall.GUID }); ok {
+		d.iid = intf.IID()
+	}
+	funcDelegateMu.Lock()
+	funcDelegateMap[d] = true
+	funcDelegateMu.Unlock()
+	p := (*win32.IUnknown)(unsafe.Pointer(d))
+	com.AddToScope(p)
+	return p
+}
+
+func NewNoArgFuncDelegate(fn any) *win32.IUnknown {
+	return newFuncDelegate(fn, 0)
+}
+
+func NewOneArgFuncDelegate(fn any) *win32.IUnknown {
+	return newFuncDelegate(fn, 1)
+}
+
+func NewTwoArgFuncDelegate(fn any) *win32.IUnknown {
+	return newFuncDelegate(fn, 2)
+}
+
+func NewThreeArgFuncDelegate(fn any) *win32.IUnknown {
+	return newFuncDelegate(fn, 3)
+}
+
+`
+
+func libVarName(libName string) string {
+	libName = strings.ReplaceAll(strings.ToLower(libName), "-", "_")
+	if strings.HasSuffix(libName, ".dll") {
+		libName = libName[:len(libName)-4]
+	}
+	return "lib" + strings.ToUpper(string(libName[0])) + libName[1:]
+}
+
+func libFileName(libName string) string {
+	libName = strings.ToLower(libName)
+	if !strings.HasSuffix(libName, ".dll") {
+		libName += ".dll"
+	}
+	return libName
+}
+
+func pkgUsesRt(pkg *gomodel.Package) bool {
+	if len(pkg.RtClasses) > 0 {
+		return true
+	}
+	for _, intf := range pkg.Interfaces {
+		if intf.Rt {
+			return true
+		}
+	}
+	for _, ft := range pkg.FuncTypes {
+		if ft.IID != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// GenSupportFile generates the runtime support code referenced by the generated
+// code of the go package pkgName, leaving out the names in declaredNameSet
+func (this *Generator) GenSupportFile(pkgName string, pkgs []*gomodel.Package,
+	declaredNameSet map[string]bool) ([]byte, error) {
+	libNameMap := make(map[string]string)
+	var rt, com bool
+	for _, pkg := range pkgs {
+		for _, sc := range pkg.SysCalls {
+			libNameMap[libVarName(sc.LibName)] = libFileName(sc.LibName)
+		}
+		if pkgUsesRt(pkg) {
+			rt = true
+		}
+		if len(pkg.Interfaces) > 0 {
+			com = true
+		}
+	}
+	if len(libNameMap) == 0 && !rt && !com {
+		return nil, nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("package " + this.basePkgName(pkgName) + "\n\n")
+	if len(libNameMap) > 0 {
+		var libVarNames []string
+		for name := range libNameMap {
+			libVarNames = append(libVarNames, name)
+		}
+		sort.Strings(libVarNames)
+		//NewLazySystemDLL only loads from the System32 directory
+		sb.WriteString("var (\n")
+		for _, name := range libVarNames {
+			sb.WriteString("\t" + name + " = windows.NewLazySystemDLL(\"" + libNameMap[name] + "\")\n")
+		}
+		sb.WriteString(")\n\n")
+		if this.SysCallBackend != SysCallBackendXSys {
+			sb.WriteString(lazyAddrCode)
+		}
+	}
+	if com {
+		sb.WriteString(comCode)
+	}
+	if rt {
+		for _, code := range []string{rtBaseCode, hstrCode, arrayCode, genericCode, boxCode, delegateCode} {
+			sb.WriteString(code)
+		}
+	}
+
+	code := sb.String()
+	if this.basePkgName(pkgName) == "win32" {
+		code = strings.ReplaceAll(code, "win32.", "")
+	}
+	code, err := omitDecls(code, declaredNameSet)
+	if err != nil {
+		return nil, err
+	}
+	return this.formatCode(SupportFileName, code, nil)
+}
+
+// handWrittenNames collects the top level names declared by the go files in the package dir
+// that are neither generated by this run nor by the previous one
+func (this *Generator) handWrittenNames(dir string, prev *manifest) (map[string]bool, error) {
+	nameSet := make(map[string]bool)
+	fis, err := ioutil.ReadDir(filepath.Join(this.OutputDir, dir))
+	if os.IsNotExist(err) {
+		return nameSet, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		relPath := path.Join(dir, fi.Name())
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".go") || fi.Name() == SupportFileName {
+			continue
+		}
+		if _, ok := this.genFileMap[relPath]; ok {
+			continue
+		}
+		if _, ok := prev.Files[relPath]; ok {
+			continue
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), filepath.Join(this.OutputDir, relPath),
+			nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range file.Decls {
+			if funcDecl, ok := decl.(*ast.FuncDecl); ok && funcDecl.Recv != nil {
+				continue //methods may extend generated types
+			}
+			for _, name := range declNames(decl) {
+				nameSet[name] = true
+			}
+		}
+	}
+	return nameSet, nil
+}
+
+// omitDecls removes the declarations of the names in nameSet from code,
+// with the methods of the removed types
+func omitDecls(code string, nameSet map[string]bool) (string, error) {
+	if len(nameSet) == 0 {
+		return code, nil
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, SupportFileName, code, parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	declares := func(names []string) bool {
+		for _, name := range names {
+			if nameSet[name] {
+				return true
+			}
+		}
+		return false
+	}
+	cmap := ast.NewCommentMap(fset, file, file.Comments)
+	var decls []ast.Decl
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if declares(declNames(decl)) {
+				continue
+			}
+		case *ast.GenDecl:
+			var specs []ast.Spec
+			for _, spec := range decl.Specs {
+				if !declares(declNames(&ast.GenDecl{Specs: []ast.Spec{spec}})) {
+					specs = append(specs, spec)
+				}
+			}
+			if len(specs) == 0 {
+				continue
+			}
+			decl.Specs = specs
+		}
+		decls = append(decls, decl)
+	}
+	file.Decls = decls
+	file.Comments = cmap.Filter(file).Comments()
+	var buf bytes.Buffer
+	err = printer.Fprint(&buf, fset, file)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
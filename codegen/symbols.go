@@ -0,0 +1,206 @@
+package codegen
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/zzl/go-winapi-gen/gomodel"
+	"github.com/zzl/go-winapi-gen/utils"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+)
+
+// symbol kinds, in precedence order when names collide
+const (
+	symbolEnum = iota
+	symbolFunc
+	symbolFuncAlias
+	symbolConst
+	symbolEnumValue
+)
+
+type symbolKey struct {
+	obj   interface{}
+	alias bool
+}
+
+type symbol struct {
+	key    symbolKey
+	kind   int
+	name   string
+	native string
+	origin string
+}
+
+// SymbolCollision records a symbol renamed because its go name was taken
+type SymbolCollision struct {
+	Pkg         string
+	Name        string
+	NewName     string
+	Origin      string
+	ClashOrigin string
+}
+
+// collectSymbols assigns the go names of the symbols that may collide within a go package.
+// explicit renames from SymbolRenameMap are applied first, then colliding symbols
+// are ordered by kind and origin, the first one keeps the name and the others
+// get "_" suffixes, so the result doesn't depend on traversal order.
+func (this *Generator) collectSymbols() {
+	this.symbolNameMap = make(map[symbolKey]string)
+	this.typeNameMap = make(map[string]string)
+	this.Collisions = nil
+
+	var pkgNames []string
+	pkgSymbolsMap := make(map[string][]*symbol)
+	for _, pkg := range this.goModel.Packages {
+		nsName := this.resolveNsName(pkg.FullName)
+		if _, ok := pkgSymbolsMap[nsName]; !ok {
+			pkgNames = append(pkgNames, nsName)
+		}
+		pkgSymbolsMap[nsName] = append(pkgSymbolsMap[nsName], this.listPkgSymbols(pkg)...)
+	}
+	sort.Strings(pkgNames)
+	for _, pkgName := range pkgNames {
+		symbols := pkgSymbolsMap[pkgName]
+		for _, s := range symbols {
+			if name, ok := this.SymbolRenameMap[s.origin]; ok {
+				s.name = name
+			} else if name, ok := this.SymbolRenameMap[s.native]; ok {
+				s.name = name
+			}
+		}
+		sort.SliceStable(symbols, func(i, j int) bool {
+			s1, s2 := symbols[i], symbols[j]
+			if s1.name != s2.name {
+				return s1.name < s2.name
+			}
+			if s1.kind != s2.kind {
+				return s1.kind < s2.kind
+			}
+			return s1.origin < s2.origin
+		})
+		nameSet := make(map[string]bool)
+		for _, s := range symbols {
+			nameSet[s.name] = true
+		}
+		usedNameMap := make(map[string]*symbol)
+		for _, s := range symbols {
+			name := s.name
+			if clash, ok := usedNameMap[name]; ok {
+				name += "_"
+				for nameSet[name] || usedNameMap[name] != nil {
+					name += "_"
+				}
+				this.Collisions = append(this.Collisions, &SymbolCollision{
+					Pkg:         pkgName,
+					Name:        s.name,
+					NewName:     name,
+					Origin:      s.origin,
+					ClashOrigin: clash.origin,
+				})
+			}
+			usedNameMap[name] = s
+			this.symbolNameMap[s.key] = name
+			if s.kind == symbolEnum && name != utils.CapSafeName(s.native) {
+				this.typeNameMap[s.origin] = name
+			}
+		}
+	}
+}
+
+func (this *Generator) listPkgSymbols(pkg *gomodel.Package) []*symbol {
+	var symbols []*symbol
+	add := func(obj interface{}, alias bool, kind int, name string, native string, origin string) {
+		symbols = append(symbols, &symbol{
+			key:    symbolKey{obj, alias},
+			kind:   kind,
+			name:   name,
+			native: native,
+			origin: pkg.FullName + "." + origin,
+		})
+	}
+	for _, con := range pkg.Consts {
+		if con.Type.Pointer && con.Type.Kind != gomodel.TypeKindPrimitive && con.Value == nil {
+			continue
+		}
+		add(con, false, symbolConst, utils.CapSafeName(con.Name), con.Name, con.Name)
+	}
+	for _, enum := range pkg.Enums {
+		add(enum, false, symbolEnum, utils.CapSafeName(enum.Name), enum.Name, enum.Name)
+		if this.PrefixEnumValuesWithTypeName {
+			continue
+		}
+		for _, value := range enum.Values {
+			add(value, false, symbolEnumValue, utils.CapName(value.Name),
+				value.Name, enum.Name+"."+value.Name)
+		}
+	}
+	aliasNameMap := sysCallAliasNames(pkg)
+	for _, sc := range pkg.SysCalls {
+		add(sc, false, symbolFunc, utils.CapName(sc.ProcName), sc.ProcName, sc.ProcName)
+		if aliasName, ok := aliasNameMap[sc]; ok {
+			native := sc.ProcName[:len(sc.ProcName)-1]
+			add(sc, true, symbolFuncAlias, aliasName, native, native)
+		}
+	}
+	return symbols
+}
+
+// WriteCollisionReport lists the symbols renamed by collectSymbols to avoid collisions
+func (this *Generator) WriteCollisionReport(w io.Writer) error {
+	for _, c := range this.Collisions {
+		_, err := fmt.Fprintf(w, "%s: %s -> %s (%s clashes with %s)\n",
+			c.Pkg, c.Name, c.NewName, c.Origin, c.ClashOrigin)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadSymbolRenameMap loads a json object mapping native names to go names,
+// keys are either ns qualified (e.g. "Windows.Win32.Foundation.S_OK",
+// "Windows.Win32.Foo.ENUM.VALUE") or bare native names
+func LoadSymbolRenameMap(filePath string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	renameMap := make(map[string]string)
+	err = json.Unmarshal(data, &renameMap)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	return renameMap, nil
+}
+
+func (this *Generator) symbolName(obj interface{}, alias bool) string {
+	name, ok := this.symbolNameMap[symbolKey{obj, alias}]
+	if !ok {
+		log.Panic("?")
+	}
+	return name
+}
+
+// W suffixed syscalls with A counterparts get aliases without the suffix
+func sysCallAliasNames(pkg *gomodel.Package) map[*gomodel.SysCall]string {
+	ansiNameSet := make(map[string]bool)
+	for _, sc := range pkg.SysCalls {
+		if strings.HasSuffix(sc.ProcName, "A") {
+			ansiNameSet[sc.ProcName] = true
+		}
+	}
+	aliasNameMap := make(map[*gomodel.SysCall]string)
+	for _, sc := range pkg.SysCalls {
+		if strings.HasSuffix(sc.ProcName, "W") {
+			nameWithNoW := sc.ProcName[:len(sc.ProcName)-1]
+			ansiName := nameWithNoW + "A"
+			if ansiNameSet[ansiName] {
+				aliasNameMap[sc] = utils.CapSafeName(nameWithNoW)
+			}
+		}
+	}
+	return aliasNameMap
+}
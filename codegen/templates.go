@@ -0,0 +1,712 @@
+package codegen
+
+import (
+	"github.com/zzl/go-winapi-gen/gomodel"
+	"github.com/zzl/go-winapi-gen/utils"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// syscall backends
+const (
+	// syscall.SyscallN on lazily resolved proc addresses, returning WIN32_ERROR
+	SysCallBackendSyscall = "syscall"
+	// golang.org/x/sys/windows LazyProc.Call, returning windows.Errno
+	SysCallBackendXSys = "xsys"
+)
+
+// DefaultTemplateText defines the default emitters: "struct", "interface", "rtInterface",
+// "class", "sysCall" and "sysCallVar", with the class parts "activator", "factoryGetter",
+// "factoryCreator", "interfaceCast", "staticInterfaceCreator" and "mustFunc".
+// templates defined in Generator.TemplateTexts with the same names replace them.
+const DefaultTemplateText = `
+{{- define "struct" -}}
+{{if .AliasName}}type {{.AliasName}} = {{.StructName}}
+{{end -}}
+type {{.StructName}} struct {
+{{- range .Fields}}
+	{{- $typeName := baseTypeName .Type}}
+	{{- if eq $typeName "string"}}{{$typeName = "HSTRING"}}{{end}}
+	{{- $name := capSafeName .Name}}
+	{{if hasPrefix $name "Anonymous"}}{{$typeName}}{{else}}{{$name}} {{$typeName}}{{end}}
+{{- end}}
+{{- with .UnionField}}
+	{{.}}
+{{- end}}
+}
+
+{{range .UnionFields}}
+{{- $typeName := baseTypeName .Type}}
+{{- $name := capSafeName .Name -}}
+func (this *{{$.StructName}}) {{$name}}() *{{$typeName}} {
+	return (*{{$typeName}})(unsafe.Pointer(this))
+}
+
+func (this *{{$.StructName}}) {{$name}}Val() {{$typeName}} {
+	return *(*{{$typeName}})(unsafe.Pointer(this))
+}
+
+{{end}}
+{{- end}}
+
+{{- define "interface" -}}
+// {{.IIDStr}}
+var IID_{{.IntfName}} = {{guidExpr .IIDStr}}
+
+type {{.IntfName}}Interface interface {
+{{- if .SuperIntfName}}
+	{{.SuperIntfName}}Interface
+{{- end}}
+{{- range .Methods}}
+	{{capSafeName .Name}}({{range $m, $p := .Params}}{{if $m}}, {{end}}{{safeName $p.Name}} {{baseTypeName $p.Type}}{{end}})
+	{{- with baseTypeName .ReturnType}} {{.}}{{end}}
+{{- end}}
+}
+
+type {{.IntfName}}Vtbl struct {
+{{- if .SuperIntfName}}
+	{{.SuperIntfName}}Vtbl
+{{- end}}
+{{- range .Methods}}
+	{{capSafeName .Name}} uintptr
+{{- end}}
+}
+
+type {{.IntfName}} struct {
+{{- if .SuperIntfName}}
+	{{.SuperIntfName}}
+{{- else}}
+	LpVtbl *[1024]uintptr
+{{- end}}
+}
+
+func (this *{{.IntfName}}) Vtbl() *{{.IntfName}}Vtbl {
+	return (*{{.IntfName}}Vtbl)(unsafe.Pointer(this.{{if .Extends}}IUnknown.{{end}}LpVtbl))
+}
+
+func (this *{{.IntfName}}) IID() *syscall.GUID {
+	return &IID_{{.IntfName}}
+}
+
+{{range .Methods}}
+{{- $retType := baseTypeName .ReturnType -}}
+func (this *{{$.IntfName}}) {{capName .Name}}({{range $m, $p := .Params}}{{if $m}}, {{end}}{{safeName $p.Name}} {{baseTypeName $p.Type}}{{end}})
+{{- with $retType}} {{.}}{{end}} {
+	{{if $retType}}ret, _, _ :{{else}}_, _, _ {{end}}= syscall.SyscallN(this.Vtbl().{{capName .Name}}, uintptr(unsafe.Pointer(this))
+	{{- range .Params}}, {{genCastToUintptr .Type (baseTypeName .Type) (safeName .Name)}}{{end}})
+{{- if $retType}}
+	return {{genCastFromUintptr .ReturnType "ret"}}
+{{- end}}
+}
+
+{{end}}
+{{- end}}
+
+{{- define "rtInterface" -}}
+// {{.IIDStr}}
+var IID_{{.IntfName}} = {{guidExpr .IIDStr}}
+
+type {{.IntfName}}Interface{{.GenDefSuffix}} interface {
+	IInspectableInterface
+{{- range .Methods}}
+	{{capSafeName .Name}}({{join (paramDecls .Params) ", "}}){{rtResults .}}
+{{- end}}
+}
+
+type {{.IntfName}}Vtbl struct {
+	IInspectableVtbl
+{{- range .Methods}}
+	{{capSafeName .Name}} uintptr
+{{- end}}
+}
+
+type {{.IntfName}}{{.GenDefSuffix}} struct {
+	IInspectable
+}
+
+func (this *{{.IntfName}}{{.GenRefSuffix}}) Vtbl() *{{.IntfName}}Vtbl {
+	return (*{{.IntfName}}Vtbl)(unsafe.Pointer(this.IUnknown.LpVtbl))
+}
+
+func (this *{{.IntfName}}{{.GenRefSuffix}}) IID() *syscall.GUID {
+{{- if .GenDefSuffix}}
+	return ParameterizedIID(this.RtSignature())
+{{- else}}
+	return &IID_{{.IntfName}}
+{{- end}}
+}
+
+func (this *{{.IntfName}}{{.GenRefSuffix}}) RtSignature() string {
+	return {{.SignatureExpr}}
+}
+
+func (this *{{.IntfName}}{{.GenRefSuffix}}) AbiArg() uintptr {
+	return uintptr(unsafe.Pointer(this))
+}
+
+func (this *{{.IntfName}}{{.GenRefSuffix}}) FromAbi() *{{.IntfName}}{{.GenRefSuffix}} {
+	if this != nil {
+		com.AddToScope(this)
+	}
+	return this
+}
+
+{{range .Methods}}
+{{- $call := rtCall .Params}}
+{{- $hasRet := not (isVoid .ReturnType)}}
+{{- $retArray := eq .ReturnType.Kind (typeKind "Array")}}
+{{- $retTypeName := ""}}{{if $hasRet}}{{$retTypeName = baseTypeName .ReturnType}}{{end}}
+{{- $zeroRet := ""}}{{if $hasRet}}{{$zeroRet = print "*new(" (rtResultTypeName .ReturnType) "), "}}{{end}}
+{{- $nilErr := ""}}{{if $call.Boxes}}{{$nilErr = ", nil"}}{{end -}}
+func (this *{{$.IntfName}}{{$.GenRefSuffix}}) {{capName .Name}}({{join (paramDecls .Params) ", "}}){{rtResults .}} {
+{{- range $call.Boxes}}
+	{{.}}
+	if err != nil {
+		return {{$zeroRet}}err
+	}
+{{- end}}
+{{- range $call.Pre}}
+	{{.}}
+{{- end}}
+{{- if $retArray}}
+	var _resultLength uint32
+	var _resultPtr unsafe.Pointer
+{{- else if $hasRet}}
+	var _result {{if eq $retTypeName "string"}}HSTRING{{else}}{{$retTypeName}}{{end}}
+{{- end}}
+	_hr, _, _ := syscall.SyscallN(this.Vtbl().{{capName .Name}}, uintptr(unsafe.Pointer(this)){{$call.Args}}
+	{{- if $retArray}}, uintptr(unsafe.Pointer(&_resultLength)), uintptr(unsafe.Pointer(&_resultPtr))
+	{{- else if $hasRet}}, uintptr(unsafe.Pointer(&_result)){{end}})
+{{- if $call.Boxes}}
+	if win32.FAILED(win32.HRESULT(_hr)) {
+		return {{$zeroRet}}syscall.Errno(uint32(_hr))
+	}
+{{- else}}
+	_ = _hr
+{{- end}}
+{{- range $call.Post}}
+	{{.}}
+{{- end}}
+{{- if not $hasRet}}
+{{- if $call.Boxes}}
+	return nil
+{{- end}}
+{{- else if $retArray}}
+	return receiveArray[{{arrayElemTypeName .ReturnType}}](_resultLength, _resultPtr){{$nilErr}}
+{{- else if eq $retTypeName "string"}}
+	return HStringToStrAndFree(_result){{$nilErr}}
+{{- else if eq .ReturnType.Kind (typeKind "Interface")}}
+	com.AddToScope(_result)
+	return _result{{$nilErr}}
+{{- else if eq .ReturnType.Kind (typeKind "GenericParam")}}
+	return _result.FromAbi(){{$nilErr}}
+{{- else if rtTypeHasRefs .ReturnType}}
+	defer _result.Release()
+	return _result.ToValue(){{$nilErr}}
+{{- else}}
+	return _result{{$nilErr}}
+{{- end}}
+}
+
+{{end}}
+{{- end}}
+
+{{- define "rtValueMethods" -}}
+func (this {{.TypeName}}) AbiArg() uintptr {
+{{- if .Struct}}
+	return structAbiArg(unsafe.Pointer(&this), unsafe.Sizeof(this))
+{{- else}}
+	return uintptr(this)
+{{- end}}
+}
+
+{{if .Refs}}// FromAbi keeps the references written by abi code, the result must be released
+{{end -}}
+func (this {{.TypeName}}) FromAbi() {{.TypeName}} {
+	return this
+}
+
+func (this {{.TypeName}}) RtSignature() string {
+	return {{printf "%q" .Signature}}
+}
+
+{{end}}
+
+{{- define "rtStructMirror" -}}
+// {{.StructName}}Value is the Go mirror of {{.StructName}}
+type {{.StructName}}Value struct {
+{{- range .Fields}}
+	{{.Name}} {{.TypeName}}
+{{- end}}
+}
+
+// ToValue copies the struct to its Go mirror, the interfaces are referenced in the current scope
+func (this *{{.StructName}}) ToValue() {{.StructName}}Value {
+	value := {{.StructName}}Value{
+{{- range .Fields}}
+		{{.Name}}: {{if eq .Ref "string"}}HStringToStr(this.{{.Name}}){{else if eq .Ref "struct"}}this.{{.Name}}.ToValue(){{else}}this.{{.Name}}{{end}},
+{{- end}}
+	}
+{{- range .Fields}}
+{{- if eq .Ref "interface"}}
+	if value.{{.Name}} != nil {
+		value.{{.Name}}.AddRef()
+		com.AddToScope(value.{{.Name}})
+	}
+{{- end}}
+{{- end}}
+	return value
+}
+
+// ToAbi converts the Go mirror to the struct, the hstrings are created in the current scope
+func (this *{{.StructName}}Value) ToAbi() {{.StructName}} {
+	return {{.StructName}}{
+{{- range .Fields}}
+		{{.Name}}: {{if eq .Ref "string"}}NewHStr(this.{{.Name}}).Ptr{{else if eq .Ref "struct"}}this.{{.Name}}.ToAbi(){{else}}this.{{.Name}}{{end}},
+{{- end}}
+	}
+}
+
+// Dup duplicates the hstrings and references the interfaces of the struct,
+// the result must be released
+func (this *{{.StructName}}) Dup() {{.StructName}} {
+	dup := *this
+{{- range .Fields}}
+{{- if eq .Ref "string"}}
+	WindowsDuplicateString(this.{{.Name}}, &dup.{{.Name}})
+{{- else if eq .Ref "struct"}}
+	dup.{{.Name}} = this.{{.Name}}.Dup()
+{{- else if eq .Ref "interface"}}
+	if dup.{{.Name}} != nil {
+		dup.{{.Name}}.AddRef()
+	}
+{{- end}}
+{{- end}}
+	return dup
+}
+
+// Release releases the hstrings and interfaces owned by the struct
+func (this *{{.StructName}}) Release() uint32 {
+{{- range .Fields}}
+{{- if eq .Ref "string"}}
+	if this.{{.Name}} != 0 {
+		WindowsDeleteString(this.{{.Name}})
+		this.{{.Name}} = 0
+	}
+{{- else if eq .Ref "struct"}}
+	this.{{.Name}}.Release()
+{{- else if eq .Ref "interface"}}
+	if this.{{.Name}} != nil {
+		this.{{.Name}}.Release()
+		this.{{.Name}} = nil
+	}
+{{- end}}
+{{- end}}
+	return 0
+}
+
+{{end}}
+
+{{- define "class" -}}
+type {{.ClassName}} struct {
+	RtClass
+{{- if .DefIntfName}}
+	*{{.DefIntfName}}
+{{- end}}
+}
+
+{{if .Activator}}{{template "activator" .}}{{end}}
+{{- range .Factories}}
+	{{- template "factoryGetter" .Getter}}
+	{{- range .Ctors}}{{template "factoryCreator" .}}{{end}}
+{{- end}}
+{{- range .Casts}}{{template "interfaceCast" .}}{{end}}
+{{- range .StaticCreators}}{{template "staticInterfaceCreator" .}}{{end}}
+{{- end}}
+
+{{- define "activator" -}}
+{{template "factoryGetter" .Activator -}}
+func New{{.ClassName}}() (*{{.ClassName}}, error) {
+	pFac, err := {{.Activator.GetterName}}()
+	if err != nil {
+		return nil, err
+	}
+	var p *IInspectable
+	hr := pFac.ActivateInstance(&p)
+	if win32.FAILED(hr) {
+		return nil, syscall.Errno(uint32(hr))
+	}
+	result := &{{.ClassName}}{
+		RtClass: RtClass{PInspect: p},
+		{{.DefIntfFieldName}}: (*{{.DefIntfName}})(unsafe.Pointer(p))}
+	com.AddToScope(result)
+	return result, nil
+}
+
+{{template "mustFunc" (mustFunc (print "New" .ClassName) nil (print "*" .ClassName))}}
+{{- end}}
+
+{{- define "factoryGetter" -}}
+var {{.VarName}} unsafe.Pointer
+
+func {{.GetterName}}() (*{{.FacIntfName}}, error) {
+	p := (*{{.FacIntfName}})(atomic.LoadPointer(&{{.VarName}}))
+	if p != nil {
+		return p, nil
+	}
+	hs := NewHStr("{{.ClassId}}")
+	hr := RoGetActivationFactory(hs.Ptr, &{{.IIDName}}, unsafe.Pointer(&p))
+	if win32.FAILED(hr) {
+		return nil, syscall.Errno(uint32(hr))
+	}
+	if !atomic.CompareAndSwapPointer(&{{.VarName}}, nil, unsafe.Pointer(p)) {
+		p.Release()
+		p = (*{{.FacIntfName}})(atomic.LoadPointer(&{{.VarName}}))
+	}
+	return p, nil
+}
+
+{{end}}
+
+{{- define "factoryCreator" -}}
+{{if .Contract}}// {{.Contract}}, version {{printf "%#x" .Version}}
+{{end -}}
+func {{.CtorName}}({{join (paramDecls .Params) ", "}}) (*{{.ClassName}}, error) {
+	pFac, err := {{.GetterName}}()
+	if err != nil {
+		return nil, err
+	}
+{{- $call := rtCall .Params}}
+{{- range $call.Boxes}}
+	{{.}}
+	if err != nil {
+		return nil, err
+	}
+{{- end}}
+{{- range $call.Pre}}
+	{{.}}
+{{- end}}
+{{- if .Composable}}
+	var inner *IInspectable //not aggregated, the inner object is not used
+{{- end}}
+	var p *{{.DefIntfName}}
+	hr, _, _ := syscall.SyscallN(pFac.Vtbl().{{capSafeName .Method.Name}}, uintptr(unsafe.Pointer(pFac)){{$call.Args}}
+	{{- if .Composable}}, 0, uintptr(unsafe.Pointer(&inner)){{end}}, uintptr(unsafe.Pointer(&p)))
+	if win32.FAILED(win32.HRESULT(hr)) {
+		return nil, syscall.Errno(uint32(hr))
+	}
+{{- if .Composable}}
+	if inner != nil {
+		inner.Release()
+	}
+{{- end}}
+{{- range $call.Post}}
+	{{.}}
+{{- end}}
+	result := &{{.ClassName}}{
+		RtClass: RtClass{PInspect: &p.IInspectable},
+		{{.DefIntfName}}: p,
+	}
+	com.AddToScope(result)
+	return result, nil
+}
+
+{{template "mustFunc" (mustFunc .CtorName (paramDecls .Params) (print "*" .ClassName))}}
+{{- end}}
+
+{{- define "interfaceCast" -}}
+func (this *{{.ClassName}}) {{.AsName}}() (*{{.IntfName}}, error) {
+	var p *{{.IntfName}}
+	hr := this.PInspect.QueryInterface(&{{.IIDName}}, unsafe.Pointer(&p))
+	if win32.FAILED(hr) {
+		return nil, syscall.Errno(uint32(hr))
+	}
+	com.AddToScope(p)
+	return p, nil
+}
+
+{{end}}
+
+{{- define "staticInterfaceCreator" -}}
+{{template "factoryGetter" .Getter -}}
+// the returned factory is cached and must not be released
+func New{{.IntfName}}() (*{{.IntfName}}, error) {
+	return {{.Getter.GetterName}}()
+}
+
+{{template "mustFunc" (mustFunc (print "New" .IntfName) nil (print "*" .IntfName))}}
+{{- end}}
+
+{{- define "mustFunc" -}}
+func Must{{.FuncName}}({{join .Params ", "}}) {{.RetTypeName}} {
+	result, err := {{.FuncName}}({{join .ArgNames ", "}})
+	if err != nil {
+		log.Panic(err)
+	}
+	return result
+}
+
+{{end}}
+
+{{- define "sysCallVar" -}}
+	p{{.FuncName}} uintptr
+{{end}}
+
+{{- define "sysCall" -}}
+{{- $void := isVoid .ReturnType -}}
+{{if .AliasName}}var {{.AliasName}} = {{.FuncName}}
+{{end -}}
+func {{.FuncName}}({{join (paramDecls .Params) ", "}})
+{{- if and (not $void) .ReturnLastError}} ({{baseTypeName .ReturnType}}, WIN32_ERROR)
+{{- else if not $void}} {{baseTypeName .ReturnType}}
+{{- else if .ReturnLastError}} WIN32_ERROR
+{{- end}} {
+	addr := lazyAddr(&p{{.FuncName}}, {{libVarName .LibName}}, "{{.ProcName}}")
+	{{if and (not $void) .ReturnLastError}}ret, _, err := {{else if not $void}}ret, _, _ := {{else if .ReturnLastError}}_, _, err := {{end -}}
+	syscall.SyscallN(addr{{range .Params}}, {{genCastToUintptr .Type (baseTypeName .Type) (safeName .Name)}}{{end}})
+{{- if not $void}}
+	return {{genCastFromUintptr .ReturnType "ret"}}{{if .ReturnLastError}}, WIN32_ERROR(err){{end}}
+{{- else if .ReturnLastError}}
+	return WIN32_ERROR(err)
+{{- end}}
+}
+
+{{end}}
+`
+
+// XSysTemplateText redefines the syscall templates for SysCallBackendXSys
+const XSysTemplateText = `
+{{- define "sysCallVar" -}}
+	proc{{.FuncName}} = {{libVarName .LibName}}.NewProc("{{.ProcName}}")
+{{end}}
+
+{{- define "sysCall" -}}
+{{- $void := isVoid .ReturnType -}}
+{{if .AliasName}}var {{.AliasName}} = {{.FuncName}}
+{{end -}}
+func {{.FuncName}}({{join (paramDecls .Params) ", "}})
+{{- if and (not $void) .ReturnLastError}} ({{baseTypeName .ReturnType}}, windows.Errno)
+{{- else if not $void}} {{baseTypeName .ReturnType}}
+{{- else if .ReturnLastError}} windows.Errno
+{{- end}} {
+	{{if and (not $void) .ReturnLastError}}ret, _, err := {{else if not $void}}ret, _, _ := {{else if .ReturnLastError}}_, _, err := {{end -}}
+	proc{{.FuncName}}.Call({{range $n, $p := .Params}}{{if $n}}, {{end}}{{genCastToUintptr .Type (baseTypeName .Type) (safeName .Name)}}{{end}})
+{{- if not $void}}
+	return {{genCastFromUintptr .ReturnType "ret"}}{{if .ReturnLastError}}, err.(windows.Errno){{end}}
+{{- else if .ReturnLastError}}
+	return err.(windows.Errno)
+{{- end}}
+}
+
+{{end}}
+`
+
+type structData struct {
+	*gomodel.Struct
+	StructName string
+	AliasName  string
+	UnionField string
+}
+
+// a struct or enum of a WinRT package, implementing RtType
+type rtValueData struct {
+	TypeName  string
+	Struct    bool
+	Signature string
+	Refs      bool //owns hstrings or interfaces
+}
+
+type rtStructMirrorData struct {
+	StructName string
+	Fields     []*rtMirrorFieldData
+}
+
+type rtMirrorFieldData struct {
+	Name     string
+	TypeName string //in the mirror
+	Ref      string //string, interface or struct, for the fields owning references
+}
+
+type interfaceData struct {
+	*gomodel.Interface
+	IIDStr        string
+	IntfName      string
+	SuperIntfName string
+	GenDefSuffix  string
+	GenRefSuffix  string
+	SignatureExpr string //rt only
+}
+
+type classData struct {
+	*gomodel.RtClass
+	ClassName        string
+	ClassId          string
+	DefIntfName      string
+	DefIntfFieldName string
+	Activator        *factoryGetterData
+	Factories        []*classFactoryData
+	Casts            []*interfaceCastData
+	StaticCreators   []*staticCreatorData
+}
+
+type factoryGetterData struct {
+	ClassId     string
+	VarName     string
+	GetterName  string
+	FacIntfName string
+	IIDName     string
+}
+
+type classFactoryData struct {
+	*gomodel.RtClassFactory
+	Getter *factoryGetterData
+	Ctors  []*factoryCreatorData
+}
+
+type factoryCreatorData struct {
+	*gomodel.RtClassFactory
+	Method      *gomodel.Method
+	Params      []*gomodel.Param
+	ClassName   string
+	CtorName    string
+	GetterName  string
+	DefIntfName string
+}
+
+type interfaceCastData struct {
+	ClassName string
+	AsName    string
+	IntfName  string
+	IIDName   string
+}
+
+type staticCreatorData struct {
+	Getter   *factoryGetterData
+	IntfName string
+}
+
+type mustFuncData struct {
+	FuncName    string
+	Params      []string
+	ArgNames    []string
+	RetTypeName string
+}
+
+type sysCallData struct {
+	*gomodel.SysCall
+	FuncName  string
+	AliasName string
+}
+
+var typeKindMap = map[string]gomodel.TypeKind{
+	"Primitive":    gomodel.TypeKindPrimitive,
+	"String":       gomodel.TypeKindString,
+	"Pointer":      gomodel.TypeKindPointer,
+	"IntPtr":       gomodel.TypeKindIntPtr,
+	"Struct":       gomodel.TypeKindStruct,
+	"Func":         gomodel.TypeKindFunc,
+	"Array":        gomodel.TypeKindArray,
+	"Interface":    gomodel.TypeKindInterface,
+	"RtClass":      gomodel.TypeKindRtClass,
+	"GenericParam": gomodel.TypeKindGenericParam,
+	"Void":         gomodel.TypeKindVoid,
+}
+
+func (this *Generator) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"baseTypeName":       this.baseTypeName,
+		"genCastToUintptr":   this.genCastToUintptr,
+		"genCastFromUintptr": this.genCastFromUintptr,
+		"transformRtParams":  this.transformRtParams,
+		"paramDecls":         this.paramDecls,
+		"paramTypeName":      this.paramTypeName,
+		"rtCall":             this.rtCall,
+		"arrayElemTypeName":  this.arrayElemTypeName,
+		"rtTypeHasRefs":      this.rtTypeHasRefs,
+		"rtResultTypeName":   this.rtResultTypeName,
+		"rtResults":          this.rtResults,
+		"mustFunc":           newMustFuncData,
+		"libVarName":         libVarName,
+		"guidExpr":           utils.BuildGuidExpr,
+		"capName":            utils.CapName,
+		"capSafeName":        utils.CapSafeName,
+		"safeName":           utils.SafeName,
+		"hasPrefix":          strings.HasPrefix,
+		"join":               strings.Join,
+		"isVoid": func(typ *gomodel.Type) bool {
+			return typ.Kind == gomodel.TypeKindVoid
+		},
+		"typeKind": func(name string) gomodel.TypeKind {
+			kind, ok := typeKindMap[name]
+			if !ok {
+				log.Panic("unknown type kind " + name)
+			}
+			return kind
+		},
+	}
+}
+
+func (this *Generator) parseTemplates() *template.Template {
+	tmpl := template.New("").Funcs(this.templateFuncs())
+	template.Must(tmpl.Parse(DefaultTemplateText))
+	switch this.SysCallBackend {
+	case "", SysCallBackendSyscall:
+	case SysCallBackendXSys:
+		template.Must(tmpl.Parse(XSysTemplateText))
+	default:
+		log.Panic("unknown syscall backend " + this.SysCallBackend)
+	}
+	for _, text := range this.TemplateTexts {
+		template.Must(tmpl.Parse(text))
+	}
+	return tmpl
+}
+
+func (this *Generator) execTemplate(name string, data interface{}) string {
+	if this.templates == nil {
+		this.templates = this.parseTemplates()
+	}
+	var sb strings.Builder
+	err := this.templates.ExecuteTemplate(&sb, name, data)
+	if err != nil {
+		log.Panic(err)
+	}
+	return sb.String()
+}
+
+// "name type" declarations of params
+func (this *Generator) paramDecls(params []*gomodel.Param) []string {
+	var decls []string
+	for _, p := range params {
+		decls = append(decls, utils.SafeName(p.Name)+" "+this.paramTypeName(p))
+	}
+	return decls
+}
+
+func newMustFuncData(funcName string, params []string, retTypeName string) *mustFuncData {
+	data := &mustFuncData{FuncName: funcName, Params: params, RetTypeName: retTypeName}
+	for _, p := range params {
+		data.ArgNames = append(data.ArgNames, p[:strings.IndexByte(p, ' ')])
+	}
+	return data
+}
+
+// LoadTemplateTexts reads the template files matching a glob pattern, in name order
+func LoadTemplateTexts(pattern string) ([]string, error) {
+	filePaths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var texts []string
+	for _, filePath := range filePaths {
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		texts = append(texts, string(data))
+	}
+	return texts, nil
+}
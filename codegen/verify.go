@@ -0,0 +1,245 @@
+package codegen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// architectures the generated code is type checked for by default
+var DefaultVerifyArchs = []string{"386", "amd64", "arm64"}
+
+// TypeError is an error found by type checking the generated code,
+// Origin is the full name of the metadata entity the code was generated from
+type TypeError struct {
+	Arch   string
+	Pos    string
+	Msg    string
+	Origin string
+}
+
+func (this *TypeError) Error() string {
+	msg := this.Pos + ": " + this.Msg + " (GOARCH=" + this.Arch
+	if this.Origin != "" {
+		msg += ", from " + this.Origin
+	}
+	return msg + ")"
+}
+
+// the fields of go list -json output used by Verify
+type listedPackage struct {
+	Dir        string
+	ImportPath string
+	GoFiles    []string
+	ImportMap  map[string]string
+	DepOnly    bool
+	Error      *struct {
+		Pos string
+		Err string
+	}
+}
+
+// Verify type checks the packages in OutputDir for GOOS=windows and each of archs,
+// DefaultVerifyArchs if none. The packages are listed by the go command, which must
+// be able to resolve the modules they require. Gen must have been called to map
+// the errors to the metadata entities.
+func (this *Generator) Verify(archs ...string) ([]*TypeError, error) {
+	if len(archs) == 0 {
+		archs = DefaultVerifyArchs
+	}
+	originMap := this.collectDeclOrigins()
+	var typeErrs []*TypeError
+	for _, arch := range archs {
+		listedPkgs, err := this.listPackages(arch)
+		if err != nil {
+			return nil, err
+		}
+		fset := token.NewFileSet()
+		checkedMap := map[string]*types.Package{"unsafe": types.Unsafe}
+		for _, lp := range listedPkgs {
+			if lp.ImportPath == "unsafe" {
+				continue
+			}
+			if lp.Error != nil && !lp.DepOnly {
+				typeErrs = append(typeErrs, &TypeError{arch, lp.Error.Pos, lp.Error.Err, ""})
+			}
+			var files []*ast.File
+			for _, fileName := range lp.GoFiles {
+				file, err := parser.ParseFile(fset, filepath.Join(lp.Dir, fileName), nil,
+					parser.SkipObjectResolution)
+				if err != nil {
+					if !lp.DepOnly {
+						typeErrs = append(typeErrs, &TypeError{arch, "", err.Error(), ""})
+					}
+					continue
+				}
+				files = append(files, file)
+			}
+			conf := &types.Config{
+				Importer: importerFunc(func(path string) (*types.Package, error) {
+					if mappedPath, ok := lp.ImportMap[path]; ok {
+						path = mappedPath
+					}
+					if pkg, ok := checkedMap[path]; ok {
+						return pkg, nil
+					}
+					return nil, fmt.Errorf("package %s not loaded", path)
+				}),
+				Sizes:            types.SizesFor("gc", arch),
+				IgnoreFuncBodies: lp.DepOnly,
+				Error: func(err error) {
+					if lp.DepOnly {
+						return
+					}
+					typeErr := err.(types.Error)
+					typeErrs = append(typeErrs, &TypeError{
+						Arch:   arch,
+						Pos:    fset.Position(typeErr.Pos).String(),
+						Msg:    typeErr.Msg,
+						Origin: findDeclOrigin(fset, files, typeErr.Pos, originMap[lp.ImportPath]),
+					})
+				},
+			}
+			checkedMap[lp.ImportPath], _ = conf.Check(lp.ImportPath, fset, files, nil)
+		}
+	}
+	return typeErrs, nil
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (this importerFunc) Import(path string) (*types.Package, error) {
+	return this(path)
+}
+
+// listPackages lists the packages in OutputDir and their dependencies, dependencies first
+func (this *Generator) listPackages(arch string) ([]*listedPackage, error) {
+	cmd := exec.Command("go", "list", "-e", "-json", "-deps", "./...")
+	cmd.Dir = this.OutputDir
+	cmd.Env = append(os.Environ(), "GOOS=windows", "GOARCH="+arch, "CGO_ENABLED=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list: %w\n%s", err, stderr.String())
+	}
+	var listedPkgs []*listedPackage
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	for {
+		lp := &listedPackage{}
+		err = decoder.Decode(lp)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		listedPkgs = append(listedPkgs, lp)
+	}
+	return listedPkgs, nil
+}
+
+// collectDeclOrigins maps the top level declarations of the generated packages
+// to the metadata entities, by import path and declared name
+func (this *Generator) collectDeclOrigins() map[string]map[string]string {
+	originMap := make(map[string]map[string]string)
+	if this.templates == nil {
+		return originMap
+	}
+	worker := this.newWorker()
+	for _, pkg := range this.goModel.Packages {
+		pkgPath := worker.importPath(worker.resolveNsName(pkg.FullName))
+		if originMap[pkgPath] == nil {
+			originMap[pkgPath] = make(map[string]string)
+		}
+		for _, chunk := range worker.genPkgChunks(pkg) {
+			code := chunk.code
+			if keyword, ok := chunkBlockMap[chunk.kind]; ok {
+				code = keyword + " (\n" + code + ")\n"
+			}
+			file, err := parser.ParseFile(token.NewFileSet(), "",
+				"package p\n\n"+code, parser.SkipObjectResolution)
+			if err != nil {
+				continue
+			}
+			for _, decl := range file.Decls {
+				for _, name := range declNames(decl) {
+					originMap[pkgPath][name] = chunk.origin
+				}
+			}
+		}
+	}
+	return originMap
+}
+
+// declNames lists the names a declaration is known by, methods by their receiver type
+func declNames(decl ast.Decl) []string {
+	var names []string
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Recv == nil || len(d.Recv.List) == 0 {
+			return []string{d.Name.Name}
+		}
+		expr := d.Recv.List[0].Type
+		if star, ok := expr.(*ast.StarExpr); ok {
+			expr = star.X
+		}
+		switch x := expr.(type) {
+		case *ast.IndexExpr:
+			expr = x.X
+		case *ast.IndexListExpr:
+			expr = x.X
+		}
+		if ident, ok := expr.(*ast.Ident); ok {
+			names = append(names, ident.Name)
+		}
+	case *ast.GenDecl:
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				names = append(names, s.Name.Name)
+			case *ast.ValueSpec:
+				for _, name := range s.Names {
+					names = append(names, name.Name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// findDeclOrigin finds the origin of the top level declaration (or block spec) at pos
+func findDeclOrigin(fset *token.FileSet, files []*ast.File, pos token.Pos,
+	originMap map[string]string) string {
+	for _, file := range files {
+		if fset.File(file.Pos()) != fset.File(pos) {
+			continue
+		}
+		for _, decl := range file.Decls {
+			if pos < decl.Pos() || pos >= decl.End() {
+				continue
+			}
+			if d, ok := decl.(*ast.GenDecl); ok {
+				for _, spec := range d.Specs {
+					if pos >= spec.Pos() && pos < spec.End() {
+						decl = &ast.GenDecl{Specs: []ast.Spec{spec}}
+						break
+					}
+				}
+			}
+			for _, name := range declNames(decl) {
+				if origin, ok := originMap[name]; ok {
+					return origin
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -10,4 +10,6 @@ type Enum struct {
 	BaseType *Type
 	Flags    bool
 	Values   []*EnumValue
+
+	RtSignature string //the winrt type signature
 }
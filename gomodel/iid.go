@@ -0,0 +1,35 @@
+package gomodel
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+// the namespace guid of winrt parameterized iids, 11f47ad5-7b73-42c0-abae-878b1e16adee
+var pinterfaceNs = []byte{0x11, 0xf4, 0x7a, 0xd5, 0x7b, 0x73, 0x42, 0xc0,
+	0xab, 0xae, 0x87, 0x8b, 0x1e, 0x16, 0xad, 0xee}
+
+// ParameterizedIID computes the iid of a generic winrt instance from its type signature
+func ParameterizedIID(sig string) syscall.GUID {
+	h := sha1.New()
+	h.Write(pinterfaceNs)
+	h.Write([]byte(sig))
+	sum := h.Sum(nil)
+	sum[6] = sum[6]&0x0f | 0x50 //version 5
+	sum[8] = sum[8]&0x3f | 0x80 //variant
+	var iid syscall.GUID
+	iid.Data1 = binary.BigEndian.Uint32(sum[0:4])
+	iid.Data2 = binary.BigEndian.Uint16(sum[4:6])
+	iid.Data3 = binary.BigEndian.Uint16(sum[6:8])
+	copy(iid.Data4[:], sum[8:16])
+	return iid
+}
+
+// RtGuidSignature formats a guid as in winrt type signatures
+func RtGuidSignature(guid *syscall.GUID) string {
+	return fmt.Sprintf("{%08x-%04x-%04x-%02x%02x-%02x%02x%02x%02x%02x%02x}",
+		guid.Data1, guid.Data2, guid.Data3, guid.Data4[0], guid.Data4[1],
+		guid.Data4[2], guid.Data4[3], guid.Data4[4], guid.Data4[5], guid.Data4[6], guid.Data4[7])
+}
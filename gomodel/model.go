@@ -5,7 +5,6 @@ import (
 	"github.com/zzl/go-winmd/apimodel"
 	"log"
 	"sort"
-	"strconv"
 	"strings"
 	"syscall"
 	"unsafe"
@@ -20,8 +19,9 @@ type ModelParser struct {
 	apiFilter      *ApiFilter
 	typeReplaceMap map[string]*Type
 	//
-	apiTypeMap map[string]*apimodel.Type
-	typeMap    map[string]*Type
+	apiTypeMap   map[string]*apimodel.Type
+	typeMap      map[string]*Type
+	genericOwner GenericType //the generic definition being parsed
 }
 
 func NewModelParser(apiModel *apimodel.Model, filter *ApiFilter,
@@ -57,11 +57,11 @@ func (this *ModelParser) Parse() *Model {
 
 	for _, pkg := range goModel.Packages {
 		for _, cls := range pkg.RtClasses {
-			if cls.FactoryType != nil && cls.FactoryType.Kind == TypePlaceHolder {
-				cls.FactoryType = this.typeMap[cls.FactoryType.Name]
-				if cls.FactoryType == nil {
-					log.Panic("?")
-				}
+			for _, fac := range cls.Factories {
+				this.resolveFactoryType(fac)
+			}
+			for _, fac := range cls.ComposableFactories {
+				this.resolveFactoryType(fac)
 			}
 		}
 	}
@@ -69,6 +69,16 @@ func (this *ModelParser) Parse() *Model {
 	return goModel
 }
 
+func (this *ModelParser) resolveFactoryType(fac *RtClassFactory) {
+	if fac.Type.Kind != TypePlaceHolder {
+		return
+	}
+	fac.Type = this.typeMap[fac.Type.Name]
+	if fac.Type == nil {
+		log.Panic("?")
+	}
+}
+
 func (this *ModelParser) addToApiTypeMap(apiType *apimodel.Type) {
 	if apiType.Kind == apimodel.TypeRef {
 		return
@@ -97,10 +107,6 @@ func (this *ModelParser) parsePkg(ns *apimodel.Namespace) *Package {
 			continue
 		}
 
-		pos = strings.IndexByte(typeName, '[')
-		if pos > 0 {
-			typeName = typeName[:pos]
-		}
 		for n, c := range typeName {
 			if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '_' || c == '`' {
 				typeName = typeName[n:]
@@ -183,6 +189,12 @@ func (this *ModelParser) parseTypeName(apiType *apimodel.Type) string {
 	if apiType.Kind == apimodel.TypeRef {
 		apiType = this.apiTypeMap[apiType.FullName]
 	}
+	if genType := this.fromGenInstToType(apiType); genType != apiType {
+		return this.parseTypeName(genType)
+	}
+	if apiType.Kind == apimodel.TypeGenericParam {
+		return this.parseGenericParam(apiType).Name
+	}
 	typ, ok := this.typeMap[apiType.FullName]
 	if ok {
 		return typ.Name
@@ -202,44 +214,188 @@ func (this *ModelParser) parseTypeName(apiType *apimodel.Type) string {
 	} else if apiType.Array {
 		elemTypeName := this.parseTypeName(apiType.ArrayDef.ElementType)
 		pos := strings.IndexByte(apiType.FullName, ']')
-		typ.Name = apiType.FullName[:pos+1] + elemTypeName
+		name = apiType.FullName[:pos+1] + elemTypeName
 	} else if apiType.Interface {
 		return "*" + name
 	}
 	return name
 }
 
+// fromGenInstToType resolves a generic instance to its generic definition
 func (this *ModelParser) fromGenInstToType(apiType *apimodel.Type) *apimodel.Type {
-	name := apiType.FullName
-	if name == "" {
+	if !apiType.GenericInst || apiType.GenericType == nil {
 		return apiType
 	}
-	cb := len(name)
-	if name[cb-1] != ']' {
-		return apiType
+	genType := apiType.GenericType
+	if genType.Kind == apimodel.TypeRef {
+		if defType, ok := this.apiTypeMap[genType.FullName]; ok {
+			genType = defType
+		}
+	}
+	return genType
+}
+
+// parseGenericInst instantiates the parsed generic definition genType as genInst
+func (this *ModelParser) parseGenericInst(genType *Type, genInst *apimodel.Type) *Type {
+	typ := genType.Clone()
+	typ.GenericParams = nil
+	typ.GenericType = genType
+	typ.GenericArgs = nil
+	for _, argType := range genInst.GenericArgTypes {
+		typ.GenericArgs = append(typ.GenericArgs, this.parseVarType(argType))
+	}
+	typ.RtSignature = this.parseRtSignature(genInst)
+	if typ.RtSignature != "" && this.hasUInt16(genInst) {
+		log.Panic("ambiguous parameterized iid of " + genInst.FullName +
+			", go-winmd names both UInt16 and Char16 uint16")
+	}
+	return typ
+}
+
+// uint16 is u2 here, though go-winmd v1.0.0 also names Char16 (c2) uint16
+var rtPrimitiveSignatures = map[string]string{
+	"bool": "b1", "int8": "i1", "byte": "u1", "int16": "i2", "uint16": "u2",
+	"int32": "i4", "uint32": "u4", "int64": "i8", "uint64": "u8",
+	"float32": "f4", "float64": "f8",
+}
+
+// hasUInt16 reports whether the winrt type signature of apiType has a uint16,
+// which may have been a Char16 in the metadata
+func (this *ModelParser) hasUInt16(apiType *apimodel.Type) bool {
+	if apiType.Kind == apimodel.TypeRef {
+		if apiType = this.apiTypeMap[apiType.FullName]; apiType == nil {
+			return false
+		}
 	}
-	bracketCount := 1
-	pCount := 1
-	for n := cb - 2; n >= 0; n-- {
-		c := name[n]
-		if c == ']' {
-			bracketCount += 1
-		} else if c == '[' {
-			bracketCount -= 1
-		}
-		if bracketCount == 1 {
-			if c == ',' {
-				pCount += 1
+	switch {
+	case apiType.GenericInst:
+		for _, argType := range apiType.GenericArgTypes {
+			if this.hasUInt16(argType) {
+				return true
+			}
+		}
+	case apiType.Primitive:
+		return apiType.Name == "uint16"
+	case apiType.Struct && apiType.StructDef != nil:
+		for _, f := range apiType.StructDef.Fields {
+			if this.hasUInt16(f.Type) {
+				return true
 			}
-		} else if bracketCount == 0 {
-			name = name[:n] + "`" + strconv.Itoa(pCount)
-			break
 		}
 	}
-	if typ, ok := this.apiTypeMap[name]; ok {
-		return typ
+	return false
+}
+
+// parseRtSignature builds the winrt type signature of apiType,
+// "" if it depends on generic params or has no winrt representation
+func (this *ModelParser) parseRtSignature(apiType *apimodel.Type) string {
+	if apiType.Kind == apimodel.TypeRef {
+		if apiType = this.apiTypeMap[apiType.FullName]; apiType == nil {
+			return ""
+		}
 	}
-	return apiType //?
+	if genType := this.fromGenInstToType(apiType); genType != apiType {
+		iid := this.parseRtIID(genType)
+		if iid == nil {
+			return ""
+		}
+		sig := "pinterface(" + RtGuidSignature(iid)
+		for _, argType := range apiType.GenericArgTypes {
+			argSig := this.parseRtSignature(argType)
+			if argSig == "" {
+				return ""
+			}
+			sig += ";" + argSig
+		}
+		return sig + ")"
+	}
+	if apiType.Generic || apiType.Pointer || apiType.Array {
+		return ""
+	}
+	if apiType.FullName == TypeGuid.Name {
+		return "g16"
+	}
+	switch {
+	case apiType.Primitive:
+		return rtPrimitiveSignatures[apiType.Name]
+	case apiType.Kind == apimodel.TypeString:
+		return "string"
+	case apiType.Kind == apimodel.TypeAny:
+		return "cinterface(IInspectable)"
+	case apiType.Enum:
+		baseSig := this.parseRtSignature(apiType.EnumDef.BaseType)
+		if baseSig == "" {
+			return ""
+		}
+		return "enum(" + apiType.FullName + ";" + baseSig + ")"
+	case apiType.Struct:
+		if apiType.StructDef == nil {
+			return ""
+		}
+		sig := "struct(" + apiType.FullName
+		for _, f := range apiType.StructDef.Fields {
+			fieldSig := this.parseRtSignature(f.Type)
+			if fieldSig == "" {
+				return ""
+			}
+			sig += ";" + fieldSig
+		}
+		return sig + ")"
+	case apiType.Interface:
+		if iid := this.parseRtIID(apiType); iid != nil {
+			return RtGuidSignature(iid)
+		}
+	case apiType.Func:
+		if iid := this.parseRtIID(apiType); iid != nil {
+			return "delegate(" + RtGuidSignature(iid) + ")"
+		}
+	case apiType.Class:
+		if apiType.ClassDef == nil || apiType.ClassDef.DefaultInterface == nil {
+			return ""
+		}
+		defSig := this.parseRtSignature(apiType.ClassDef.DefaultInterface)
+		if defSig == "" {
+			return ""
+		}
+		return "rc(" + apiType.FullName + ";" + defSig + ")"
+	}
+	return ""
+}
+
+// parseRtIID reads the winrt guid attribute of an interface or delegate
+func (this *ModelParser) parseRtIID(apiType *apimodel.Type) *syscall.GUID {
+	for _, a := range apiType.Attributes {
+		if a.Type.FullName == "Windows.Foundation.Metadata.GuidAttribute" {
+			iid := this.parseGuidAttrValue(a.Args)
+			return &iid
+		}
+	}
+	return nil
+}
+
+// parseGenericParam resolves a generic param reference against the definition being parsed
+func (this *ModelParser) parseGenericParam(apiType *apimodel.Type) *Type {
+	owner := this.genericOwner
+	index := int(apiType.GenericParamIndex)
+	if owner == nil || index >= len(owner.GetGenericParams()) {
+		log.Panic("?")
+	}
+	return &Type{
+		Kind:              TypeKindGenericParam,
+		Name:              owner.GetGenericParams()[index],
+		GenericParamOwner: owner,
+		GenericParamIndex: index,
+	}
+}
+
+// whether the type depends on the generic params of the definition being parsed
+func refersToGenericParam(apiType *apimodel.Type) bool {
+	if apiType.Pointer {
+		return refersToGenericParam(apiType.PointerTo)
+	} else if apiType.Array {
+		return refersToGenericParam(apiType.ArrayDef.ElementType)
+	}
+	return apiType.Kind == apimodel.TypeGenericParam
 }
 
 func (this *ModelParser) resolveApiTypeNs(apiType *apimodel.Type) *apimodel.Namespace {
@@ -253,7 +409,19 @@ func (this *ModelParser) resolveApiTypeNs(apiType *apimodel.Type) *apimodel.Name
 }
 
 func (this *ModelParser) parseVarType(apiType *apimodel.Type) *Type {
-	genArgTypes := apiType.GenericArgTypes
+	if apiType.Pointer && apiType.PointerTo.GenericInst { //out param
+		elemType := this.parseVarType(apiType.PointerTo)
+		return &Type{
+			Kind:        TypeKindPointer,
+			Name:        "*" + elemType.Name,
+			Size:        TypeSize{PtrSize, PtrSize},
+			Pointer:     true,
+			GenericType: elemType.GenericType,
+			GenericArgs: elemType.GenericArgs,
+			RtSignature: elemType.RtSignature,
+		}
+	}
+	genInst := apiType
 	apiType = this.fromGenInstToType(apiType)
 	if apiType.Kind == apimodel.TypeRef {
 		if defType, ok := this.apiTypeMap[apiType.FullName]; ok {
@@ -296,11 +464,8 @@ func (this *ModelParser) parseVarType(apiType *apimodel.Type) *Type {
 	} else if typ.Kind == TypeKindRtClass {
 		typ = this.parseVarType(apiType.ClassDef.DefaultInterface)
 	}
-	if len(genArgTypes) > 0 {
-		typ = typ.Clone()
-		for _, gat := range genArgTypes {
-			typ.GenericArgs = append(typ.GenericArgs, this.parseVarType(gat))
-		}
+	if apiType != genInst {
+		typ = this.parseGenericInst(typ, genInst)
 	}
 	return typ
 
@@ -314,9 +479,17 @@ func (this *ModelParser) parseType(apiType *apimodel.Type) *Type {
 			log.Panic("?")
 		}
 	}
+	if genType := this.fromGenInstToType(apiType); genType != apiType {
+		return this.parseGenericInst(this.parseType(genType), apiType)
+	}
+	if apiType.Kind == apimodel.TypeGenericParam {
+		return this.parseGenericParam(apiType)
+	}
 
-	typ, ok := this.typeMap[apiType.FullName]
-	if !ok {
+	var typ *Type
+	if refersToGenericParam(apiType) {
+		typ = &Type{} //not shared between generic definitions
+	} else if typ = this.typeMap[apiType.FullName]; typ == nil {
 		typ = &Type{}
 		this.typeMap[apiType.FullName] = typ
 	}
@@ -397,19 +570,11 @@ func (this *ModelParser) parseType(apiType *apimodel.Type) *Type {
 		typ.Kind = TypeKindInterface
 		typ.Name = "*" + typ.Name             //???
 		typ.Size = TypeSize{PtrSize, PtrSize} //?
-		if len(apiType.GenericArgTypes) > 0 {
-			typ = typ.Clone()
-			for _, gat := range apiType.GenericArgTypes {
-				typ.GenericArgs = append(typ.GenericArgs, this.parseVarType(gat))
-			}
-		}
 	} else if apiType.Kind == apimodel.TypeClass {
 		typ.Kind = TypeKindRtClass            //?
 		typ.Size = TypeSize{PtrSize, PtrSize} //?
 	} else if apiType.Kind == apimodel.TypeAny {
 		typ.Kind = TypeKindStruct
-	} else if apiType.Kind == apimodel.TypeGenericParam {
-		typ.Kind = TypeKindGenericParam //?
 	} else if apiType.Kind == apimodel.TypeVoid {
 		typ.Kind = TypeKindVoid //??
 	} else if apiType.Kind == apimodel.TypePrimitive {
@@ -441,6 +606,9 @@ func (this *ModelParser) checkUnionSize(def *apimodel.UnionDef) TypeSize {
 			maxAlignSize = size.AlignSize
 		}
 	}
+	if maxSize != 0 && maxSize%maxAlignSize != 0 {
+		maxSize += maxAlignSize - maxSize%maxAlignSize
+	}
 	return TypeSize{maxSize, maxAlignSize}
 }
 
@@ -473,6 +641,7 @@ func (this *ModelParser) parseEnum(apiEnum *apimodel.Type) *Enum {
 	enumDef := apiEnum.EnumDef
 	enum.BaseType = this.parseType(enumDef.BaseType)
 	enum.Flags = enumDef.Flags
+	enum.RtSignature = this.parseRtSignature(apiEnum)
 	for _, v := range enumDef.Values {
 		enum.Values = append(enum.Values, this.parseEnumValue(v))
 	}
@@ -488,11 +657,10 @@ func (this *ModelParser) parseEnumValue(apiConst *apimodel.Constant) *EnumValue
 
 func buildNestedTypeName(apiType *apimodel.Type) string {
 	if apiType.EnclosingType != nil {
-		typeName := apiType.Name
-		if typeName[0] == '_' {
-			typeName = typeName[1:]
+		typeName := strings.TrimPrefix(apiType.Name, "_")
+		if typeName != "" {
+			typeName = strings.ToUpper(typeName[0:1]) + typeName[1:]
 		}
-		typeName = strings.ToUpper(typeName[0:1]) + typeName[1:]
 		return buildNestedTypeName(apiType.EnclosingType) + "_" + typeName
 	} else {
 		return apiType.Name
@@ -512,6 +680,7 @@ func (this *ModelParser) parseStruct(apiStruct *apimodel.Type) *Struct {
 	if len(apiStruct.StructDef.Constants) > 0 {
 		log.Panic("?")
 	}
+	s.RtSignature = this.parseRtSignature(apiStruct)
 	return s
 }
 
@@ -548,13 +717,15 @@ func (this *ModelParser) parseFunc(apiType *apimodel.Type) *FuncType {
 	ft := &FuncType{}
 	apiFunc := apiType.FuncDef
 	ft.Name = apiFunc.Name
+	ft.GenericParams = apiType.GenericDefParams
+	genericOwner := this.genericOwner
+	this.genericOwner = ft
 	for _, apiParam := range apiFunc.Params {
 		ft.Params = append(ft.Params, this.parseParam(apiParam))
 	}
 
 	ft.ReturnType = this.parseVarType(apiFunc.ReturnType)
-
-	ft.GenericParams = apiType.GenericDefParams
+	this.genericOwner = genericOwner
 
 	for _, a := range apiType.Attributes {
 		if a.Type.Name == "GuidAttribute" {
@@ -571,7 +742,22 @@ func (this *ModelParser) parseFunc(apiType *apimodel.Type) *FuncType {
 func (this *ModelParser) parseParam(apiParam *apimodel.Param) *Param {
 	p := &Param{}
 	p.Name = apiParam.Name
-	p.Type = this.parseVarType(apiParam.Type)
+	apiType := apiParam.Type
+	if apiParam.Out && apiType.Pointer && apiType.PointerTo.Array &&
+		apiType.PointerTo.ArrayDef.DimSizes == nil {
+		p.Type = this.parseVarType(apiType.PointerTo)
+		p.ArrayKind = ArrayReceive
+	} else {
+		p.Type = this.parseVarType(apiType)
+		if apiType.Array && apiType.ArrayDef.DimSizes == nil {
+			//the byref of a receive array may be dropped, leaving it as a fill array
+			if apiParam.Out {
+				p.ArrayKind = ArrayFill
+			} else {
+				p.ArrayKind = ArrayPass
+			}
+		}
+	}
 	if apiParam.In {
 		p.Flags |= ParamIn
 	}
@@ -623,6 +809,8 @@ func (this *ModelParser) parseInterface(apiInterface *apimodel.Type) *Interface
 		Type: this.parseType(apiInterface),
 	}
 	intf.Name = apiInterface.Name
+	genericOwner := this.genericOwner
+	this.genericOwner = intf
 	interfaceDef := apiInterface.InterfaceDef
 	for _, extend := range interfaceDef.Extends {
 		intf.Extends = append(intf.Extends, this.parseType(extend))
@@ -642,6 +830,7 @@ func (this *ModelParser) parseInterface(apiInterface *apimodel.Type) *Interface
 	for _, apiMethod := range interfaceDef.Methods {
 		intf.Methods = append(intf.Methods, this.parseMethod(apiMethod))
 	}
+	this.genericOwner = genericOwner
 	return intf
 }
 
@@ -699,16 +888,47 @@ func (this *ModelParser) parseRtClass(apiClass *apimodel.Type) *RtClass {
 			if _, ok := arg0.(uint32); ok {
 				rc.DirectActivatable = true
 			} else {
-				rc.FactoryType = &Type{
-					Kind: TypePlaceHolder,
-					Name: arg0.(string),
+				fac := &RtClassFactory{
+					Type: &Type{
+						Kind: TypePlaceHolder,
+						Name: arg0.(string),
+					},
 				}
+				fac.Version, fac.Contract = this.parseVersionAttrArgs(a.Args[1:])
+				rc.Factories = append(rc.Factories, fac)
+			}
+		} else if a.Type.FullName == "Windows.Foundation.Metadata.ComposableAttribute" {
+			fac := &RtClassFactory{
+				Type: &Type{
+					Kind: TypePlaceHolder,
+					Name: a.Args[0].(string),
+				},
+				Composable: true,
 			}
+			//CompositionType: Protected = 1, Public = 2
+			if compositionType, ok := a.Args[1].(int32); ok {
+				fac.Public = compositionType == 2
+			}
+			fac.Version, fac.Contract = this.parseVersionAttrArgs(a.Args[2:])
+			rc.ComposableFactories = append(rc.ComposableFactories, fac)
 		}
 	}
 	return rc
 }
 
+// version, [contract name | platform]
+func (this *ModelParser) parseVersionAttrArgs(args []interface{}) (uint32, string) {
+	var version uint32
+	var contract string
+	if len(args) > 0 {
+		version, _ = args[0].(uint32)
+	}
+	if len(args) > 1 {
+		contract, _ = args[1].(string)
+	}
+	return version, contract
+}
+
 func (this *ModelParser) checkReplaceType(fullName string) *Type {
 	return this.typeReplaceMap[fullName]
 }
@@ -0,0 +1,435 @@
+package gomodel
+
+import (
+	"github.com/zzl/go-winapi-gen/internal/apitest"
+	"github.com/zzl/go-winmd/apimodel"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var primApiTypes = []*apimodel.Type{
+	apitest.Prim("int8", 1, false), apitest.Prim("uint8", 1, true),
+	apitest.Prim("int16", 2, false), apitest.Prim("uint16", 2, true),
+	apitest.Prim("int32", 4, false), apitest.Prim("uint32", 4, true),
+	apitest.Prim("int64", 8, false), apitest.Prim("float64", 8, false),
+	apitest.Prim("uintptr", PtrSize, true),
+}
+
+// newRandomApiModel builds a random graph of structs, unions, enums, aliases
+// and interfaces over a few namespaces, each type referring only to earlier ones
+func newRandomApiModel(rnd *rand.Rand) *apimodel.Model {
+	model := &apimodel.Model{}
+	for _, nsName := range []string{"Rand.A", "Rand.B", "Rand.B.C"} {
+		ns := &apimodel.Namespace{FullName: nsName, Name: nsName[strings.LastIndexByte(nsName, '.')+1:]}
+		model.AllNamespaces = append(model.AllNamespaces, ns)
+	}
+	valueTypes := append([]*apimodel.Type{}, primApiTypes...)
+	var refTypes, genInstTypes []*apimodel.Type
+	fieldType := func() *apimodel.Type {
+		switch rnd.Intn(6) {
+		case 0:
+			if len(refTypes) > 0 && rnd.Intn(2) == 0 {
+				return apitest.Ptr(refTypes[rnd.Intn(len(refTypes))])
+			}
+			return apitest.Ptr(valueTypes[rnd.Intn(len(valueTypes))])
+		case 1:
+			return apitest.Array(valueTypes[rnd.Intn(len(valueTypes))], uint32(1+rnd.Intn(5)))
+		case 2:
+			return apitest.Ptr(apitest.Array(valueTypes[rnd.Intn(len(valueTypes))], uint32(1+rnd.Intn(5))))
+		}
+		return valueTypes[rnd.Intn(len(valueTypes))]
+	}
+	paramType := func() *apimodel.Type {
+		if len(genInstTypes) > 0 && rnd.Intn(3) == 0 {
+			genInstType := genInstTypes[rnd.Intn(len(genInstTypes))]
+			if rnd.Intn(2) == 0 {
+				return apitest.Ptr(genInstType)
+			}
+			return genInstType
+		}
+		return fieldType()
+	}
+	fields := func() []*apimodel.Field {
+		var fields []*apimodel.Field
+		for n := rnd.Intn(5); n >= 0; n-- {
+			fields = append(fields, &apimodel.Field{Name: "F" + strconv.Itoa(len(fields)),
+				Type: fieldType()})
+		}
+		return fields
+	}
+	typeCount := 1 + rnd.Intn(16)
+	for n := 0; n < typeCount; n++ {
+		ns := model.AllNamespaces[rnd.Intn(len(model.AllNamespaces))]
+		typ := &apimodel.Type{Name: "T" + strconv.Itoa(n), Namespace: ns}
+		typ.FullName = ns.FullName + "." + typ.Name
+		switch rnd.Intn(6) {
+		case 0, 1:
+			typ.Kind, typ.Struct = apimodel.TypeStruct, true
+			typ.StructDef = &apimodel.StructDef{Fields: fields()}
+			if rnd.Intn(2) == 0 {
+				nestedType := &apimodel.Type{Kind: apimodel.TypeUnion, Union: true,
+					Name: "_Anonymous_e__Union", FullName: typ.FullName + "._Anonymous_e__Union",
+					Namespace: ns, EnclosingType: typ,
+					UnionDef: &apimodel.UnionDef{Fields: fields()}}
+				typ.NestedTypes = append(typ.NestedTypes, nestedType)
+				typ.StructDef.Fields = append(typ.StructDef.Fields,
+					&apimodel.Field{Name: "Anonymous", Type: nestedType})
+			}
+			valueTypes = append(valueTypes, typ)
+		case 2:
+			typ.Kind, typ.Union = apimodel.TypeUnion, true
+			typ.UnionDef = &apimodel.UnionDef{Fields: fields()}
+			valueTypes = append(valueTypes, typ)
+		case 3:
+			typ.Kind, typ.Enum = apimodel.TypeEnum, true
+			typ.EnumDef = &apimodel.EnumDef{BaseType: primApiTypes[rnd.Intn(6)],
+				Values: []*apimodel.Constant{{Name: typ.Name + "_V", Value: int32(1)}}}
+			valueTypes = append(valueTypes, typ)
+		case 4:
+			typ.Kind, typ.Alias = apimodel.TypeAlias, true
+			typ.AliasType = fieldType()
+			valueTypes = append(valueTypes, typ)
+		case 5:
+			typ.Kind, typ.Interface = apimodel.TypeInterface, true
+			typ.InterfaceDef = &apimodel.InterfaceDef{}
+			if rnd.Intn(2) == 0 {
+				typ.Name += "`1"
+				typ.FullName += "`1"
+				typ.Generic, typ.GenericDefParams = true, []string{"T"}
+				typ.InterfaceDef.Methods = append(typ.InterfaceDef.Methods, &apimodel.Method{
+					Name:       "Get",
+					ReturnType: apitest.GenericParam(0),
+				})
+				genInstTypes = append(genInstTypes, apitest.GenericInst(typ, paramType()))
+			} else {
+				typ.InterfaceDef.Methods = append(typ.InterfaceDef.Methods, &apimodel.Method{
+					Name:       "Set",
+					Params:     []*apimodel.Param{{Name: "value", Type: paramType(), In: true}},
+					ReturnType: primApiTypes[4],
+				})
+				refTypes = append(refTypes, typ)
+			}
+		}
+		ns.Types = append(ns.Types, typ)
+	}
+	return model
+}
+
+// checkApiModel parses a random model and checks the invariants of the go model
+func checkApiModel(t *testing.T, seed int64) {
+	rnd := rand.New(rand.NewSource(seed))
+	apiModel := newRandomApiModel(rnd)
+	parser := NewModelParser(apiModel, nil, nil)
+	goModel := parser.Parse()
+
+	nameSet := map[string]bool{"unsafe.Pointer": true}
+	for _, typ := range primApiTypes {
+		nameSet[typ.Name] = true
+	}
+	for _, ns := range apiModel.AllNamespaces {
+		for _, typ := range ns.Types {
+			nameSet[typ.FullName] = true
+			for _, genParam := range typ.GenericDefParams {
+				nameSet[genParam] = true
+			}
+			for _, nestedType := range typ.NestedTypes {
+				nameSet[buildNestedTypeName(nestedType)] = true
+			}
+		}
+	}
+	prefixRe := regexp.MustCompile("^(\\*|\\[[0-9]*\\])*")
+	for _, pkg := range goModel.Packages {
+		for _, typeName := range pkg.CollectTypeNames() {
+			name := prefixRe.ReplaceAllString(typeName, "")
+			if !nameSet[name] {
+				t.Errorf("seed %d: %s: type name %q does not resolve", seed, pkg.FullName, typeName)
+			}
+		}
+	}
+	for fullName, typ := range parser.typeMap {
+		if typ.Kind != TypeKindStruct && typ.Kind != TypeKindArray {
+			continue
+		}
+		size := typ.Size
+		if size.AlignSize == 0 || size.TotalSize%size.AlignSize != 0 {
+			t.Errorf("seed %d: %s: size %d is not a multiple of alignment %d",
+				seed, fullName, size.TotalSize, size.AlignSize)
+		}
+	}
+}
+
+func TestRandomApiModels(t *testing.T) {
+	for seed := int64(0); seed < 200; seed++ {
+		checkApiModel(t, seed)
+	}
+}
+
+func FuzzParseApiModel(f *testing.F) {
+	f.Add(int64(1))
+	f.Add(int64(42))
+	f.Fuzz(checkApiModel)
+}
+
+func TestGenericParams(t *testing.T) {
+	ns := &apimodel.Namespace{Name: "Collections", FullName: "Ns.Collections"}
+	newGenType := func(name string, params ...string) *apimodel.Type {
+		return &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: name,
+			FullName: ns.FullName + "." + name, Namespace: ns, Generic: true,
+			GenericDefParams: params, InterfaceDef: &apimodel.InterfaceDef{}}
+	}
+	// both refer to []`2, which must not be shared
+	imap := newGenType("IMap`2", "K", "V")
+	ilookup := newGenType("ILookup`2", "TKey", "TValue")
+	for _, genType := range []*apimodel.Type{imap, ilookup} {
+		items := &apimodel.Param{Name: "items", Type: apitest.Array(apitest.GenericParam(1), 0), In: true}
+		genType.InterfaceDef.Methods = []*apimodel.Method{{Name: "GetMany",
+			Params: []*apimodel.Param{items}, ReturnType: apitest.GenericParam(1)}}
+	}
+	ns.Types = []*apimodel.Type{imap, ilookup}
+	goModel := NewModelParser(&apimodel.Model{AllNamespaces: []*apimodel.Namespace{ns}}, nil, nil).Parse()
+
+	for n, intf := range goModel.Packages[0].Interfaces {
+		method := intf.Methods[0]
+		retType, itemsType := method.ReturnType, method.Params[0].Type
+		if retType.Kind != TypeKindGenericParam || retType.GenericParamOwner != intf ||
+			retType.GenericParamIndex != 1 || retType.Name != ns.Types[n].GenericDefParams[1] {
+			t.Errorf("%s: unexpected return type %+v", intf.Name, retType)
+		}
+		if itemsType.Name != "[0]"+retType.Name {
+			t.Errorf("%s: unexpected param type %s", intf.Name, itemsType.Name)
+		}
+	}
+}
+
+func TestArrayParams(t *testing.T) {
+	ns := &apimodel.Namespace{Name: "Widgets", FullName: "Ns.Widgets"}
+	int32Type := apitest.Prim("int32", 4, false)
+	szArray := &apimodel.Type{Kind: apimodel.TypeArray, Array: true, Name: "[]int32",
+		FullName: "[]int32", ArrayDef: &apimodel.ArrayDef{ElementType: int32Type}}
+	params := []*apimodel.Param{
+		{Name: "passed", Type: szArray, In: true},
+		{Name: "filled", Type: szArray, Out: true},
+		{Name: "received", Type: apitest.Ptr(szArray), Out: true},
+		{Name: "fixed", Type: apitest.Array(int32Type, 4), In: true},
+	}
+	iwidget := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IWidget",
+		FullName: ns.FullName + ".IWidget", Namespace: ns, InterfaceDef: &apimodel.InterfaceDef{
+			Methods: []*apimodel.Method{{Name: "Exchange", Params: params,
+				ReturnType: &apimodel.Type{Kind: apimodel.TypeVoid, Name: "void", FullName: "void"}}}}}
+	ns.Types = []*apimodel.Type{iwidget}
+	goModel := NewModelParser(&apimodel.Model{AllNamespaces: []*apimodel.Namespace{ns}}, nil, nil).Parse()
+
+	kinds := []ArrayKind{ArrayPass, ArrayFill, ArrayReceive, ArrayNone}
+	for n, p := range goModel.Packages[0].Interfaces[0].Methods[0].Params {
+		if p.ArrayKind != kinds[n] {
+			t.Errorf("%s: array kind %d, want %d", p.Name, p.ArrayKind, kinds[n])
+		}
+		if p.Type.Kind != TypeKindArray {
+			t.Errorf("%s: unexpected param type %s", p.Name, p.Type.Name)
+		}
+	}
+}
+
+// checks the signatures and parameterized iids of instances of the
+// real generic definitions against the iids in the windows sdk headers
+func TestParameterizedIIDs(t *testing.T) {
+	ns := &apimodel.Namespace{Name: "Foundation", FullName: "Windows.Foundation"}
+	newGenType := func(name string, attr *apimodel.Attribute) *apimodel.Type {
+		return &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: name,
+			FullName: ns.FullName + "." + name, Namespace: ns, Generic: true,
+			GenericDefParams: []string{"T"}, InterfaceDef: &apimodel.InterfaceDef{},
+			Attributes: []*apimodel.Attribute{attr}}
+	}
+	ivector := newGenType("IVector`1", apitest.RtGuidAttr(0x913337e9, 0x11a1, 0x4345,
+		0xa3, 0xa2, 0x4e, 0x7f, 0x95, 0x6e, 0x22, 0x2d))
+	iiterable := newGenType("IIterable`1", apitest.RtGuidAttr(0xfaa585ea, 0x6214, 0x4217,
+		0xaf, 0xda, 0x7f, 0x46, 0xde, 0x58, 0x69, 0xb3))
+	iasyncOp := newGenType("IAsyncOperation`1", apitest.RtGuidAttr(0x9fc2b0bb, 0xe446, 0x44e2,
+		0xaa, 0x61, 0x9c, 0xab, 0x8f, 0x63, 0x6a, 0xf2))
+	ireference := newGenType("IReference`1", apitest.RtGuidAttr(0x61c17706, 0x2d65, 0x11e0,
+		0x9a, 0xe8, 0xd4, 0x85, 0x64, 0x01, 0x54, 0x72))
+	float32Type := apitest.Prim("float32", 4, false)
+	point := &apimodel.Type{Kind: apimodel.TypeStruct, Struct: true, Name: "Point",
+		FullName: "Windows.Foundation.Point", Namespace: ns, StructDef: &apimodel.StructDef{
+			Fields: []*apimodel.Field{{Name: "X", Type: float32Type}, {Name: "Y", Type: float32Type}}}}
+	stringType := &apimodel.Type{Kind: apimodel.TypeString, Name: "string", FullName: "string"}
+	tests := []struct {
+		apiType *apimodel.Type
+		sig     string
+		iid     string
+	}{
+		{apitest.GenericInst(ivector, stringType),
+			"pinterface({913337e9-11a1-4345-a3a2-4e7f956e222d};string)",
+			"{98b9acc1-4b56-532e-ac73-03d5291cca90}"},
+		{apitest.GenericInst(iiterable, stringType),
+			"pinterface({faa585ea-6214-4217-afda-7f46de5869b3};string)",
+			"{e2fcc7c1-3bfc-5a0b-b2b0-72e769d1cb7e}"},
+		{apitest.GenericInst(iasyncOp, apitest.Prim("bool", 1, false)),
+			"pinterface({9fc2b0bb-e446-44e2-aa61-9cab8f636af2};b1)",
+			"{cdb5efb3-5788-509d-9be1-71ccb8a3362a}"},
+		{apitest.GenericInst(ireference, apitest.Prim("int32", 4, false)),
+			"pinterface({61c17706-2d65-11e0-9ae8-d48564015472};i4)",
+			"{548cefbd-bc8a-5fa0-8df2-957440fc8bf4}"},
+		{apitest.GenericInst(ireference, point),
+			"pinterface({61c17706-2d65-11e0-9ae8-d48564015472};struct(Windows.Foundation.Point;f4;f4))",
+			"{84f14c22-a00a-5272-8d3d-82112e66df00}"},
+		{apitest.GenericInst(ivector, apitest.GenericParam(0)), "", ""},
+	}
+	iholder := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IHolder`1",
+		FullName: ns.FullName + ".IHolder`1", Namespace: ns, Generic: true,
+		GenericDefParams: []string{"T"}, InterfaceDef: &apimodel.InterfaceDef{}}
+	for n, test := range tests {
+		iholder.InterfaceDef.Methods = append(iholder.InterfaceDef.Methods,
+			&apimodel.Method{Name: "Get" + strconv.Itoa(n), ReturnType: test.apiType})
+	}
+	ns.Types = []*apimodel.Type{ivector, iiterable, iasyncOp, ireference, point, iholder}
+	goModel := NewModelParser(&apimodel.Model{AllNamespaces: []*apimodel.Namespace{ns}}, nil, nil).Parse()
+
+	pkg := goModel.Packages[0]
+	if pkg.Structs[0].RtSignature != "struct(Windows.Foundation.Point;f4;f4)" {
+		t.Errorf("unexpected struct signature %s", pkg.Structs[0].RtSignature)
+	}
+	methods := pkg.Interfaces[len(pkg.Interfaces)-1].Methods
+	for n, test := range tests {
+		sig := methods[n].ReturnType.RtSignature
+		if sig != test.sig {
+			t.Errorf("%s: unexpected signature %s", test.apiType.Name, sig)
+			continue
+		}
+		if sig == "" {
+			continue
+		}
+		iid := ParameterizedIID(sig)
+		if sIID := RtGuidSignature(&iid); sIID != test.iid {
+			t.Errorf("%s: unexpected iid %s", test.apiType.Name, sIID)
+		}
+	}
+	if insts := pkg.CollectGenericInsts(); len(insts) != len(tests)-1 {
+		t.Errorf("unexpected instance count %d", len(insts))
+	}
+}
+
+// go-winmd names both UInt16 and Char16 uint16, so instances over them have no certain iid
+func TestUInt16GenericInst(t *testing.T) {
+	uint16Type := apitest.Prim("uint16", 2, true)
+	version := &apimodel.Type{Kind: apimodel.TypeStruct, Struct: true, Name: "Version",
+		StructDef: &apimodel.StructDef{Fields: apitest.Fields("Major", uint16Type)}}
+	ireference := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: "IReference`1",
+		Generic: true, GenericDefParams: []string{"T"}, InterfaceDef: &apimodel.InterfaceDef{},
+		Attributes: []*apimodel.Attribute{apitest.RtGuidAttr(0x61c17706, 0x2d65, 0x11e0,
+			0x9a, 0xe8, 0xd4, 0x85, 0x64, 0x01, 0x54, 0x72)}}
+	ns := apitest.Ns("Windows.Foundation", ireference, version)
+	for _, argType := range []*apimodel.Type{uint16Type, version} {
+		parser := NewModelParser(apitest.Model(ns), nil, nil)
+		parser.Parse()
+		if parser.parseRtSignature(version) != "struct(Windows.Foundation.Version;u2)" {
+			t.Errorf("unexpected struct signature %s", parser.parseRtSignature(version))
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("no panic for IReference[%s]", argType.FullName)
+				}
+			}()
+			parser.parseVarType(apitest.GenericInst(ireference, argType))
+		}()
+	}
+}
+
+// newFuzzGenericInst builds a possibly nested generic instance driven by data,
+// referring to the definitions by TypeRef or directly
+func newFuzzGenericInst(data []byte, genTypes []*apimodel.Type, depth int) (*apimodel.Type, []byte) {
+	next := func() int {
+		if len(data) == 0 {
+			return 0
+		}
+		b := int(data[0])
+		data = data[1:]
+		return b
+	}
+	b := next()
+	if depth > 3 || b%4 == 0 {
+		return primApiTypes[b%len(primApiTypes)], data
+	}
+	genType := genTypes[b%len(genTypes)]
+	var argTypes []*apimodel.Type
+	for range genType.GenericDefParams {
+		var argType *apimodel.Type
+		argType, data = newFuzzGenericInst(data, genTypes, depth+1)
+		argTypes = append(argTypes, argType)
+	}
+	typ := apitest.GenericInst(genType, argTypes...)
+	if next()%2 == 0 {
+		typ.GenericType = &apimodel.Type{Kind: apimodel.TypeRef,
+			Name: genType.Name, FullName: genType.FullName}
+	}
+	return typ, data
+}
+
+// checkGenericInst checks that the parsed type mirrors the instance structure
+func checkGenericInst(t *testing.T, apiType *apimodel.Type, typ *Type) {
+	if !apiType.GenericInst {
+		if typ.Name != apiType.Name || typ.IsGenericInst() {
+			t.Errorf("%s parsed as %s", apiType.FullName, typ.Name)
+		}
+		return
+	}
+	if !typ.IsGenericInst() || typ.GenericType.Name != "*"+apiType.GenericType.FullName ||
+		typ.Name != typ.GenericType.Name || len(typ.GenericArgs) != len(apiType.GenericArgTypes) {
+		t.Errorf("%s parsed as %s", apiType.FullName, typ.Name)
+		return
+	}
+	for n, argType := range apiType.GenericArgTypes {
+		checkGenericInst(t, argType, typ.GenericArgs[n])
+	}
+}
+
+func FuzzGenericInst(f *testing.F) {
+	f.Add([]byte{1, 0})
+	f.Add([]byte{2, 1, 4, 1, 3, 4, 5, 0, 1, 0})
+	f.Add([]byte{3, 2, 3, 1, 1, 2, 3, 3, 1, 1})
+	ns := &apimodel.Namespace{Name: "Collections", FullName: "Ns.Collections"}
+	for _, name := range []string{"IVector`1", "IMap`2", "IKeyValuePair`2"} {
+		genType := &apimodel.Type{Kind: apimodel.TypeInterface, Interface: true, Name: name,
+			FullName: ns.FullName + "." + name, Namespace: ns, Generic: true,
+			InterfaceDef: &apimodel.InterfaceDef{}}
+		for n := 0; n < int(name[len(name)-1]-'0'); n++ {
+			genType.GenericDefParams = append(genType.GenericDefParams, "T"+strconv.Itoa(n))
+		}
+		ns.Types = append(ns.Types, genType)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parser := NewModelParser(&apimodel.Model{AllNamespaces: []*apimodel.Namespace{ns}}, nil, nil)
+		parser.Parse()
+		apiType, _ := newFuzzGenericInst(data, ns.Types, 0)
+		typ := parser.parseVarType(apiType)
+		checkGenericInst(t, apiType, typ)
+		if apiType.GenericInst {
+			checkGenericInst(t, apiType, parser.parseType(apiType))
+			ptrType := parser.parseVarType(apitest.Ptr(apiType))
+			if ptrType.Name != "*"+typ.Name || ptrType.GenericType != typ.GenericType ||
+				len(ptrType.GenericArgs) != len(typ.GenericArgs) {
+				t.Errorf("*%s parsed as %s", apiType.FullName, ptrType.Name)
+			}
+		}
+	})
+}
+
+func FuzzBuildNestedTypeName(f *testing.F) {
+	f.Add("Outer/_Anonymous_e__Union/_Anonymous1_e__Struct")
+	f.Add("Outer/_")
+	f.Add("Outer/")
+	f.Fuzz(func(t *testing.T, names string) {
+		var apiType *apimodel.Type
+		for _, name := range strings.Split(names, "/") {
+			apiType = &apimodel.Type{Name: name, EnclosingType: apiType}
+		}
+		typeName := buildNestedTypeName(apiType)
+		if strings.Count(typeName, "_") < strings.Count(names, "/") {
+			t.Errorf("%q built as %q", names, typeName)
+		}
+	})
+}
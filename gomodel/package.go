@@ -21,49 +21,49 @@ type Package struct {
 func (this *Package) CollectTypeNames() []string {
 	typeNameSet := make(map[string]bool)
 	for _, t := range this.TypeAliases {
-		typeNameSet[t.Type.Name] = true
+		addTypeNames(typeNameSet, t.Type)
 	}
 	for _, c := range this.Consts {
-		typeNameSet[c.Type.Name] = true
+		addTypeNames(typeNameSet, c.Type)
 	}
 	for _, v := range this.Vars {
-		typeNameSet[v.Type.Name] = true
+		addTypeNames(typeNameSet, v.Type)
 	}
 	for _, e := range this.Enums {
-		typeNameSet[e.BaseType.Name] = true
+		addTypeNames(typeNameSet, e.BaseType)
 	}
 	for _, s := range this.Structs {
 		for _, f := range s.Fields {
-			typeNameSet[f.Type.Name] = true
+			addTypeNames(typeNameSet, f.Type)
 		}
 		for _, f := range s.UnionFields {
-			typeNameSet[f.Type.Name] = true
+			addTypeNames(typeNameSet, f.Type)
 		}
 	}
 	for _, f := range this.FuncTypes {
 		for _, p := range f.Params {
-			typeNameSet[p.Type.Name] = true
+			addTypeNames(typeNameSet, p.Type)
 		}
 		if f.ReturnType != nil {
-			typeNameSet[f.ReturnType.Name] = true
+			addTypeNames(typeNameSet, f.ReturnType)
 		}
 	}
 	for _, i := range this.Interfaces {
 		for _, m := range i.Methods {
 			for _, p := range m.Params {
-				typeNameSet[p.Type.Name] = true
+				addTypeNames(typeNameSet, p.Type)
 			}
 			if m.ReturnType != nil {
-				typeNameSet[m.ReturnType.Name] = true
+				addTypeNames(typeNameSet, m.ReturnType)
 			}
 		}
 	}
 	for _, s := range this.SysCalls {
 		for _, p := range s.Params {
-			typeNameSet[p.Type.Name] = true
+			addTypeNames(typeNameSet, p.Type)
 		}
 		if s.ReturnType != nil {
-			typeNameSet[s.ReturnType.Name] = true
+			addTypeNames(typeNameSet, s.ReturnType)
 		}
 	}
 	var names []string
@@ -73,3 +73,66 @@ func (this *Package) CollectTypeNames() []string {
 	sort.Strings(names)
 	return names
 }
+
+// adds the names of typ and of its generic args
+func addTypeNames(typeNameSet map[string]bool, typ *Type) {
+	typeNameSet[typ.Name] = true
+	for _, argType := range typ.GenericArgs {
+		addTypeNames(typeNameSet, argType)
+	}
+}
+
+// CollectGenericInsts collects the closed generic instances referenced by the package,
+// the ones with a winrt signature, sorted by signature
+func (this *Package) CollectGenericInsts() []*Type {
+	instMap := make(map[string]*Type)
+	for _, f := range this.FuncTypes {
+		for _, p := range f.Params {
+			addGenericInsts(instMap, p.Type)
+		}
+		if f.ReturnType != nil {
+			addGenericInsts(instMap, f.ReturnType)
+		}
+	}
+	for _, i := range this.Interfaces {
+		for _, t := range i.Extends {
+			addGenericInsts(instMap, t)
+		}
+		for _, m := range i.Methods {
+			for _, p := range m.Params {
+				addGenericInsts(instMap, p.Type)
+			}
+			if m.ReturnType != nil {
+				addGenericInsts(instMap, m.ReturnType)
+			}
+		}
+	}
+	for _, c := range this.RtClasses {
+		if c.DefaultInterface != nil {
+			addGenericInsts(instMap, c.DefaultInterface)
+		}
+		for _, t := range c.Interfaces {
+			addGenericInsts(instMap, t)
+		}
+	}
+	var sigs []string
+	for sig := range instMap {
+		sigs = append(sigs, sig)
+	}
+	sort.Strings(sigs)
+	var insts []*Type
+	for _, sig := range sigs {
+		insts = append(insts, instMap[sig])
+	}
+	return insts
+}
+
+// adds typ and the instances in its generic args
+func addGenericInsts(instMap map[string]*Type, typ *Type) {
+	if typ.RtSignature != "" && instMap[typ.RtSignature] == nil {
+		instMap[typ.RtSignature] = typ
+	}
+	for _, argType := range typ.GenericArgs {
+		addGenericInsts(instMap, argType)
+	}
+}
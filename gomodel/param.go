@@ -8,8 +8,20 @@ const (
 	ParamOptional ParamFlag = 4
 )
 
+// ArrayKind is the winrt convention of an array param
+type ArrayKind byte
+
+const (
+	ArrayNone    ArrayKind = 0
+	ArrayPass    ArrayKind = 1 //in, caller allocated
+	ArrayFill    ArrayKind = 2 //out, caller allocated and callee filled
+	ArrayReceive ArrayKind = 3 //out by ref, callee allocated and freed by the caller with CoTaskMemFree
+)
+
 type Param struct {
 	Flags ParamFlag
 	Name  string
-	Type  *Type
+	Type  *Type //the array type for ArrayReceive
+
+	ArrayKind ArrayKind
 }
@@ -1,11 +1,22 @@
 package gomodel
 
+type RtClassFactory struct {
+	Type     *Type
+	Version  uint32
+	Contract string
+
+	//composable
+	Composable bool
+	Public     bool
+}
+
 type RtClass struct {
 	Name string
 
-	Static            bool
-	DirectActivatable bool
-	FactoryType       *Type //multiple?
+	Static              bool
+	DirectActivatable   bool
+	Factories           []*RtClassFactory
+	ComposableFactories []*RtClassFactory
 
 	DefaultInterface *Type
 	Interfaces       []*Type
@@ -4,4 +4,6 @@ type Struct struct {
 	Name        string
 	Fields      []*Field
 	UnionFields []*Field
+
+	RtSignature string //the winrt type signature, "" if not a winrt struct
 }
@@ -30,13 +30,22 @@ type Type struct {
 	Pointer  bool //*,unsafe.Pointer,uintptr
 
 	GenericParams []string
-	GenericArgs   []*Type
+	GenericType   *Type   //the generic definition of an instance
+	GenericArgs   []*Type //the type args of an instance, in GenericType.GenericParams order
+	RtSignature   string  //the winrt type signature of a closed instance, for its parameterized iid
+
+	GenericParamOwner GenericType //the generic definition declaring a generic param
+	GenericParamIndex int
 }
 
 func (this *Type) GetGenericParams() []string {
 	return this.GenericParams
 }
 
+func (this *Type) IsGenericInst() bool {
+	return this.GenericType != nil
+}
+
 func (this *Type) Clone() *Type {
 	t := *this
 	return &t
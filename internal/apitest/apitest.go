@@ -0,0 +1,120 @@
+// Package apitest builds apimodel fixtures the way the go-winmd parser fills them,
+// shared by the tests of the model and the code generator
+package apitest
+
+import (
+	"github.com/zzl/go-winmd/apimodel"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var Void = &apimodel.Type{Kind: apimodel.TypeVoid, Void: true}
+
+func Model(nss ...*apimodel.Namespace) *apimodel.Model {
+	model := &apimodel.Model{AllNamespaces: nss}
+	for _, ns := range nss {
+		if ns.Parent == nil {
+			model.RootNamespaces = append(model.RootNamespaces, ns)
+		}
+	}
+	sort.Slice(model.AllNamespaces, func(i, j int) bool {
+		return model.AllNamespaces[i].FullName < model.AllNamespaces[j].FullName
+	})
+	return model
+}
+
+// Ns places the types and their nested types in a new namespace
+func Ns(fullName string, types ...*apimodel.Type) *apimodel.Namespace {
+	ns := &apimodel.Namespace{FullName: fullName, Types: types}
+	ns.Name = fullName[strings.LastIndexByte(fullName, '.')+1:]
+	for _, typ := range types {
+		typ.Namespace = ns
+		typ.FullName = fullName + "." + typ.Name
+		for _, nestedType := range typ.NestedTypes {
+			nestedType.Namespace = ns
+			nestedType.FullName = typ.FullName + "." + nestedType.Name
+		}
+	}
+	return ns
+}
+
+// Prim creates a primitive type, named as go-winmd names it, Char16 as uint16 too
+func Prim(name string, size int, unsigned bool) *apimodel.Type {
+	return &apimodel.Type{Kind: apimodel.TypePrimitive, Primitive: true,
+		Name: name, FullName: name, Size: size, Unsigned: unsigned}
+}
+
+func Ptr(typ *apimodel.Type) *apimodel.Type {
+	return &apimodel.Type{Kind: apimodel.TypePointer, Pointer: true, PointerTo: typ,
+		Name: "*" + typ.Name, FullName: "*" + typ.FullName}
+}
+
+// Array creates a fixed array with one dim size, or a winrt szarray without
+func Array(elemType *apimodel.Type, dimSizes ...uint32) *apimodel.Type {
+	typ := &apimodel.Type{Kind: apimodel.TypeArray, Array: true,
+		ArrayDef: &apimodel.ArrayDef{ElementType: elemType, DimSizes: dimSizes}}
+	if len(dimSizes) == 1 {
+		typ.Name = "[" + strconv.Itoa(int(dimSizes[0])) + "]" + elemType.FullName
+	} else {
+		typ.Name = "[]" + elemType.FullName
+	}
+	typ.FullName = typ.Name
+	return typ
+}
+
+func GenericParam(index uint32) *apimodel.Type {
+	name := "`" + strconv.Itoa(int(index)+1)
+	return &apimodel.Type{Kind: apimodel.TypeGenericParam, GenericParam: true,
+		GenericParamIndex: index, Name: name, FullName: name}
+}
+
+// GenericInst instantiates a generic interface or delegate
+func GenericInst(genType *apimodel.Type, argTypes ...*apimodel.Type) *apimodel.Type {
+	var argNames []string
+	for _, argType := range argTypes {
+		argNames = append(argNames, argType.FullName)
+	}
+	name := genType.Name[:strings.IndexByte(genType.Name, '`')] +
+		"[" + strings.Join(argNames, ", ") + "]"
+	typ := &apimodel.Type{Kind: genType.Kind, GenericInst: true, GenericType: genType,
+		GenericArgTypes: argTypes, Name: name,
+		FullName:  genType.FullName[:len(genType.FullName)-len(genType.Name)] + name,
+		Namespace: genType.Namespace}
+	typ.Interface, typ.InterfaceDef = genType.Interface, genType.InterfaceDef
+	typ.Func, typ.FuncDef = genType.Func, genType.FuncDef
+	return typ
+}
+
+func Attr(fullName string, args ...interface{}) *apimodel.Attribute {
+	name := fullName[strings.LastIndexByte(fullName, '.')+1:]
+	return &apimodel.Attribute{Type: &apimodel.Type{Kind: apimodel.TypeRef,
+		Name: name, FullName: fullName}, Args: args}
+}
+
+// RtGuidAttr creates the guid attribute of winrt types
+func RtGuidAttr(data1 uint32, data2, data3 uint16, data4 ...uint8) *apimodel.Attribute {
+	args := []interface{}{data1, data2, data3}
+	for _, b := range data4 {
+		args = append(args, b)
+	}
+	return Attr("Windows.Foundation.Metadata.GuidAttribute", args...)
+}
+
+func Param(name string, typ *apimodel.Type) *apimodel.Param {
+	return &apimodel.Param{Name: name, Type: typ, In: true}
+}
+
+func OutParam(name string, typ *apimodel.Type) *apimodel.Param {
+	return &apimodel.Param{Name: name, Type: typ, Out: true}
+}
+
+// Fields creates struct fields from name, type pairs
+func Fields(nameTypes ...interface{}) []*apimodel.Field {
+	var fields []*apimodel.Field
+	for n := 0; n < len(nameTypes); n += 2 {
+		fields = append(fields, &apimodel.Field{Name: nameTypes[n].(string),
+			Type: nameTypes[n+1].(*apimodel.Type)})
+	}
+	return fields
+}
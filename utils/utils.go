@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"io/ioutil"
 	"log"
 	"os"
@@ -54,6 +55,23 @@ func BuildGuidExpr(sGuid string) string {
 	return expr
 }
 
+// HandWrittenMarker is a line marking a file in the output directory as hand-written,
+// such files are never removed or overwritten by the generator
+const HandWrittenMarker = "//winapi-gen:handwritten"
+
+func IsHandWritten(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if string(bytes.TrimSpace(line)) == HandWrittenMarker {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanDir removes all files but the digit prefixed ones in a directory tree.
+//
+// Deprecated: the generator removes its stale output by the manifest in the output dir,
+// see codegen.Generator.MigrateOutput for the output of versions without one
 func CleanDir(dir string) {
 	fis, err := ioutil.ReadDir(dir)
 	if err != nil {